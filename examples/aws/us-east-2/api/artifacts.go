@@ -0,0 +1,197 @@
+package main
+
+import (
+	"debug/buildinfo"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultDrafterVersion  = "v0.5.0"
+	defaultArtifactBaseURL = "https://github.com/loopholelabs/drafter/releases/download"
+	// defaultDrafterBinDir is where install_drafter.sh puts the binaries
+	defaultDrafterBinDir = "/usr/local/bin"
+)
+
+const (
+	artifactDrafterOS = "drafteros"
+	artifactValkey    = "valkey"
+)
+
+// artifactFiles are the release assets the API downloads
+var artifactFiles = map[string]string{
+	artifactDrafterOS: "drafteros-oci-x86_64_pvm.tar.zst",
+	artifactValkey:    "oci-valkey-x86_64.tar.zst",
+}
+
+// versionBinaries are every drafter binary the API runs, which have to be the
+// release the artifacts come from
+var versionBinaries = []string{"drafter-packager", "drafter-snapshotter", "drafter-nat", "drafter-peer", "drafter-forwarder"}
+
+// versionFile is written next to the drafter binaries by install_drafter.sh
+// and names the release it installed
+const versionFile = "drafter.version"
+
+var releaseVersion = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?$`)
+
+// ArtifactSource is where DrafterOS and the default workload are downloaded
+// from: <BaseURL>/<Version>/<file>, which is the layout of the GitHub
+// releases and of a mirror of them. An override replaces the location of one
+// artifact with a URL or an absolute path on this host.
+type ArtifactSource struct {
+	Version   string            `yaml:"version"`
+	BaseURL   string            `yaml:"base_url"`
+	Overrides map[string]string `yaml:"overrides"`
+	// BinDir holds the drafter binaries of Version. They are run by their
+	// path in it, so sudo's secure_path plays no part in which one runs.
+	BinDir string `yaml:"bin_dir"`
+	// SkipVersionCheck lets packages be built with drafter binaries whose
+	// release cannot be told
+	SkipVersionCheck bool `yaml:"skip_version_check"`
+}
+
+func defaultArtifactSource() ArtifactSource {
+	return ArtifactSource{
+		Version:   defaultDrafterVersion,
+		BaseURL:   defaultArtifactBaseURL,
+		Overrides: map[string]string{},
+		BinDir:    defaultDrafterBinDir,
+	}
+}
+
+// binary is the path a drafter binary is run from
+func (s ArtifactSource) binary(name string) string {
+	return filepath.Join(s.BinDir, name)
+}
+
+// location is the URL or path an artifact is fetched from
+func (s ArtifactSource) location(artifact string) string {
+	if override, ok := s.Overrides[artifact]; ok {
+		return override
+	}
+	return strings.TrimRight(s.BaseURL, "/") + "/" + s.Version + "/" + artifactFiles[artifact]
+}
+
+func artifactNames() string {
+	names := make([]string, 0, len(artifactFiles))
+	for name := range artifactFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (s ArtifactSource) validate() error {
+	if !releaseVersion.MatchString(s.Version) {
+		return fmt.Errorf("drafter version must be a release tag such as %s, got %q", defaultDrafterVersion, s.Version)
+	}
+	if u, err := url.Parse(s.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("artifact base URL must be an http(s) URL, got %q", s.BaseURL)
+	}
+	if !filepath.IsAbs(s.BinDir) {
+		return fmt.Errorf("drafter bin dir must be an absolute path, got %q", s.BinDir)
+	}
+	for name, location := range s.Overrides {
+		if _, ok := artifactFiles[name]; !ok {
+			return fmt.Errorf("unknown artifact %q, must be one of %s", name, artifactNames())
+		}
+		w := Workload{Package: location}
+		if w.isURL() {
+			if u, err := url.Parse(location); err != nil || u.Host == "" {
+				return fmt.Errorf("artifact %s: invalid URL %q", name, location)
+			}
+		} else if !filepath.IsAbs(location) {
+			return fmt.Errorf("artifact %s must be an http(s) URL or an absolute path, got %q", name, location)
+		}
+	}
+	return nil
+}
+
+// drafterVersion finds the release of the drafter binary at path: the one
+// install_drafter.sh recorded next to it, or else the module version it was
+// built as. It is empty when neither is known.
+func drafterVersion(path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	if version, err := readVersionFile(filepath.Join(filepath.Dir(path), versionFile)); err != nil || version != "" {
+		return version, err
+	}
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read build info of %s: %v", path, err)
+	}
+	if info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "", nil
+	}
+	return info.Main.Version, nil
+}
+
+// readVersionFile reads a release tag written by install_drafter.sh, or ""
+// when there is no such file
+func readVersionFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	version := strings.TrimSpace(string(data))
+	if !releaseVersion.MatchString(version) {
+		return "", fmt.Errorf("%s holds %q, not a release tag", path, version)
+	}
+	return version, nil
+}
+
+// checkDrafterVersion refuses to build a package with drafter binaries from
+// another release than the artifacts, or whose release cannot be told unless
+// the check is skipped
+func (s ArtifactSource) checkDrafterVersion() error {
+	if s.SkipVersionCheck {
+		return nil
+	}
+	for _, binary := range versionBinaries {
+		version, err := drafterVersion(s.binary(binary))
+		if err != nil {
+			return fmt.Errorf("cannot check the version of %s: %v", binary, err)
+		}
+		if version == "" {
+			return fmt.Errorf("cannot tell the version of %s, install drafter %s with install_drafter.sh or set -skip-drafter-version-check", binary, s.Version)
+		}
+		if version != s.Version {
+			return fmt.Errorf("%s is %s but the artifacts are %s, install drafter %s or set -drafter-version %s", binary, version, s.Version, s.Version, version)
+		}
+	}
+	return nil
+}
+
+// artifactsFlag parses artifact=location pairs into the overrides
+type artifactsFlag map[string]string
+
+func (f artifactsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, location := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, location))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f artifactsFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, location, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || location == "" {
+			return fmt.Errorf("invalid artifact override %q, expected artifact=url-or-path", pair)
+		}
+		f[name] = location
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// installDrafter writes stand-ins for the drafter binaries into a directory,
+// recording version in drafter.version unless it is empty
+func installDrafter(t *testing.T, version string, binaries ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, binary := range binaries {
+		if err := os.WriteFile(filepath.Join(dir, binary), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version != "" {
+		if err := os.WriteFile(filepath.Join(dir, versionFile), []byte(version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCheckDrafterVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		binDir  string
+		skip    bool
+		wantErr string
+	}{
+		{"matching release", installDrafter(t, "v0.5.0", versionBinaries...), false, ""},
+		{"other release", installDrafter(t, "v0.4.2", versionBinaries...), false, "is v0.4.2 but the artifacts are v0.5.0"},
+		{"missing forwarder", installDrafter(t, "v0.5.0", versionBinaries[:4]...), false, "drafter-forwarder"},
+		{"unknown release", installDrafter(t, "", versionBinaries...), false, "cannot check the version of drafter-packager"},
+		{"unknown release skipped", installDrafter(t, "", versionBinaries...), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := defaultArtifactSource()
+			source.BinDir = tt.binDir
+			source.SkipVersionCheck = tt.skip
+			err := source.checkDrafterVersion()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkDrafterVersion() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkDrafterVersion() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Every binary the API runs is checked
+	for _, binary := range []string{"drafter-nat", "drafter-peer", "drafter-forwarder", "drafter-snapshotter", "drafter-packager"} {
+		found := false
+		for _, checked := range versionBinaries {
+			found = found || checked == binary
+		}
+		if !found {
+			t.Errorf("%s is not version checked", binary)
+		}
+	}
+}
+
+func TestReadVersionFile(t *testing.T) {
+	dir := t.TempDir()
+	if version, err := readVersionFile(filepath.Join(dir, versionFile)); err != nil || version != "" {
+		t.Errorf("readVersionFile() of a missing file = %q, %v, want no version", version, err)
+	}
+
+	path := filepath.Join(dir, versionFile)
+	if err := os.WriteFile(path, []byte("latest\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readVersionFile(path); err == nil {
+		t.Error("readVersionFile() accepted a version that is not a release tag")
+	}
+}
+
+func TestArtifactSourceValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(s *ArtifactSource)
+		wantErr bool
+	}{
+		{"defaults", func(s *ArtifactSource) {}, false},
+		{"pre-release", func(s *ArtifactSource) { s.Version = "v0.6.0-rc.1" }, false},
+		{"branch", func(s *ArtifactSource) { s.Version = "main" }, true},
+		{"mirror", func(s *ArtifactSource) { s.BaseURL = "https://files.internal/drafter" }, false},
+		{"base url without scheme", func(s *ArtifactSource) { s.BaseURL = "files.internal/drafter" }, true},
+		{"path override", func(s *ArtifactSource) { s.Overrides[artifactDrafterOS] = "/srv/drafteros.tar.zst" }, false},
+		{"relative override", func(s *ArtifactSource) { s.Overrides[artifactValkey] = "valkey.tar.zst" }, true},
+		{"unknown artifact", func(s *ArtifactSource) { s.Overrides["kernel"] = "/srv/vmlinux" }, true},
+		{"relative bin dir", func(s *ArtifactSource) { s.BinDir = "bin" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := defaultArtifactSource()
+			tt.modify(&source)
+			if err := source.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArtifactLocation(t *testing.T) {
+	source := defaultArtifactSource()
+	source.BaseURL = "https://files.internal/drafter/"
+	source.Overrides[artifactValkey] = "/srv/valkey.tar.zst"
+
+	if got, want := source.location(artifactDrafterOS), "https://files.internal/drafter/v0.5.0/drafteros-oci-x86_64_pvm.tar.zst"; got != want {
+		t.Errorf("location(drafteros) = %q, want %q", got, want)
+	}
+	if got := source.location(artifactValkey); got != "/srv/valkey.tar.zst" {
+		t.Errorf("location(valkey) = %q, want the override", got)
+	}
+	if got := source.binary("drafter-peer"); got != "/usr/local/bin/drafter-peer" {
+		t.Errorf("binary(drafter-peer) = %q, want it in the bin dir", got)
+	}
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BlueprintBuilding = "building"
+	BlueprintReady    = "ready"
+	BlueprintFailed   = "failed"
+)
+
+// Blueprints live next to the VM trees. VM names cannot start with '_', so
+// the two never collide on disk, in the logs or in the job queue.
+const blueprintsKey = "_blueprints"
+
+var (
+	blueprintsBucket = []byte("blueprints")
+
+	ErrBlueprintNotFound = errors.New("blueprint not found")
+	ErrBlueprintExists   = errors.New("blueprint already exists")
+	ErrBlueprintInUse    = errors.New("blueprint is used by VMs")
+)
+
+var (
+	blueprintPhases       = []string{"prepare", "download", "extract", "resize", "nat", "snapshot", "verify"}
+	blueprintCreatePhases = []string{"prepare"}
+)
+
+// Blueprint is a verified package that VMs can be created from without
+// downloading, extracting or snapshotting anything
+type Blueprint struct {
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+	Error string `json:"error,omitempty"`
+
+	PackageSpec
+
+	Dir          string `json:"dir"`
+	BlueprintDir string `json:"blueprint_dir"`
+	PackageDir   string `json:"package_dir"`
+	LogsPath     string `json:"logs_path,omitempty"`
+
+	// Netns is only held while the snapshotter runs
+	Netns string `json:"netns,omitempty"`
+
+	Files         map[string]int64       `json:"files,omitempty"`
+	PackageConfig map[string]interface{} `json:"package_config,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// blueprintRequest is the body of POST /blueprints
+type blueprintRequest struct {
+	Name string `json:"name"`
+	PackageSpec
+}
+
+// blueprintOwner is the name a blueprint's jobs and processes run under
+func blueprintOwner(name string) string {
+	return blueprintsKey + "/" + name
+}
+
+// ownerBlueprint returns the blueprint an owner from blueprintOwner names
+func ownerBlueprint(owner string) (string, bool) {
+	return strings.CutPrefix(owner, blueprintsKey+"/")
+}
+
+func (cfg Config) setBlueprintPaths(bp *Blueprint) {
+	bp.Dir = filepath.Join(cfg.DataRoot, blueprintsKey, bp.Name)
+	bp.BlueprintDir = filepath.Join(bp.Dir, "blueprint")
+	bp.PackageDir = filepath.Join(bp.Dir, "package")
+}
+
+func getBlueprint(b *bolt.Bucket, name string) (*Blueprint, error) {
+	data := b.Get([]byte(name))
+	if data == nil {
+		return nil, ErrBlueprintNotFound
+	}
+
+	var bp Blueprint
+	if err := json.Unmarshal(data, &bp); err != nil {
+		return nil, fmt.Errorf("failed to decode blueprint %s: %v", name, err)
+	}
+	return &bp, nil
+}
+
+func putBlueprint(b *bolt.Bucket, bp *Blueprint) error {
+	data, err := json.Marshal(bp)
+	if err != nil {
+		return fmt.Errorf("failed to encode blueprint %s: %v", bp.Name, err)
+	}
+	return b.Put([]byte(bp.Name), data)
+}
+
+func (r *Registry) GetBlueprint(name string) (*Blueprint, error) {
+	var bp *Blueprint
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		bp, err = getBlueprint(tx.Bucket(blueprintsBucket), name)
+		return err
+	})
+	return bp, err
+}
+
+// ReplaceBlueprint stores bp in place of any blueprint with the same name,
+// which needs replace and no VMs created from it. The check and the write
+// share a transaction, so no VM can start using the old blueprint in
+// between. It returns the blueprint it replaced, or nil, and the VMs that
+// are in the way.
+func (r *Registry) ReplaceBlueprint(bp *Blueprint, replace bool) (*Blueprint, []string, error) {
+	var previous *Blueprint
+	var users []string
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blueprintsBucket)
+
+		existing, err := getBlueprint(b, bp.Name)
+		if err == nil {
+			previous = existing
+			if !replace {
+				return ErrBlueprintExists
+			}
+			if users, err = blueprintUsers(tx, bp.Name); err != nil {
+				return err
+			}
+			if len(users) > 0 {
+				return ErrBlueprintInUse
+			}
+		} else if !errors.Is(err, ErrBlueprintNotFound) {
+			return err
+		}
+
+		now := time.Now().UTC()
+		bp.CreatedAt = now
+		bp.UpdatedAt = now
+		return putBlueprint(b, bp)
+	})
+	return previous, users, err
+}
+
+// RestoreBlueprint undoes a build that could not be queued: the blueprint
+// goes back to previous, or is removed if there was none. A blueprint that
+// is no longer building is left alone.
+func (r *Registry) RestoreBlueprint(name string, previous *Blueprint) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blueprintsBucket)
+
+		bp, err := getBlueprint(b, name)
+		if err != nil {
+			return err
+		}
+		if bp.Phase != BlueprintBuilding {
+			return nil
+		}
+		if previous == nil {
+			return b.Delete([]byte(name))
+		}
+		log.Printf("Blueprint %s: back to %s, its build could not be queued", name, previous.Phase)
+		return putBlueprint(b, previous)
+	})
+}
+
+// UpdateBlueprint applies fn to the stored blueprint inside a single transaction
+func (r *Registry) UpdateBlueprint(name string, fn func(bp *Blueprint) error) (*Blueprint, error) {
+	var bp *Blueprint
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blueprintsBucket)
+
+		var err error
+		bp, err = getBlueprint(b, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(bp); err != nil {
+			return err
+		}
+
+		bp.UpdatedAt = time.Now().UTC()
+		return putBlueprint(b, bp)
+	})
+	return bp, err
+}
+
+func (r *Registry) ListBlueprints() ([]*Blueprint, error) {
+	var bps []*Blueprint
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blueprintsBucket).ForEach(func(k, v []byte) error {
+			var bp Blueprint
+			if err := json.Unmarshal(v, &bp); err != nil {
+				return fmt.Errorf("failed to decode blueprint %s: %v", k, err)
+			}
+			bps = append(bps, &bp)
+			return nil
+		})
+	})
+	return bps, err
+}
+
+// AcquireBlueprint assigns a free namespace to a blueprint build
+func (a *NetnsAllocator) AcquireBlueprint(name string) (string, error) {
+	var netns string
+	err := a.registry.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blueprintsBucket)
+		bp, err := getBlueprint(b, name)
+		if err != nil {
+			return err
+		}
+		if bp.Netns == "" {
+			if bp.Netns, err = a.pick(tx); err != nil {
+				return err
+			}
+			bp.UpdatedAt = time.Now().UTC()
+			if err := putBlueprint(b, bp); err != nil {
+				return err
+			}
+		}
+		netns = bp.Netns
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Assigned netns %s to blueprint %s", netns, name)
+	return netns, nil
+}
+
+// blueprintUsers returns the VMs created from a blueprint that still exist
+func blueprintUsers(tx *bolt.Tx, name string) ([]string, error) {
+	var users []string
+	if err := tx.Bucket(vmsBucket).ForEach(func(k, v []byte) error {
+		var rec VMRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return fmt.Errorf("failed to decode record for %s: %v", k, err)
+		}
+		if rec.Config.Blueprint == name && rec.Phase != PhaseDeleted {
+			users = append(users, rec.Name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// BlueprintUsers returns the VMs created from a blueprint that still exist
+func (r *Registry) BlueprintUsers(name string) ([]string, error) {
+	var users []string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		users, err = blueprintUsers(tx, name)
+		return err
+	})
+	return users, err
+}
+
+func (api *DrafterAPI) createBlueprint(c *gin.Context) {
+	var req blueprintRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("Error parsing request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateName("blueprint", req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := api.registeredWorkload(&req.PackageSpec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts, err := req.PackageSpec.Resolve(api.config.Artifacts.defaultWorkload())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Workload = &opts.Workload
+	req.CPUTemplate = opts.CPUTemplate
+
+	replace := false
+	if value := c.Query("replace"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid replace value %q", value)})
+			return
+		}
+		replace = parsed
+	}
+
+	owner := blueprintOwner(req.Name)
+	if id, busy := api.jobs.Active(owner); busy {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("blueprint %s has job %s in progress", req.Name, id), "job_id": id})
+		return
+	}
+
+	// VMs read their base devices from the blueprint's package, so it is
+	// only rebuilt once they are gone
+	bp := &Blueprint{Name: req.Name, Phase: BlueprintBuilding, PackageSpec: req.PackageSpec}
+	api.config.setBlueprintPaths(bp)
+	previous, users, err := api.registry.ReplaceBlueprint(bp, replace)
+	switch {
+	case errors.Is(err, ErrBlueprintExists):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("blueprint %s already exists, pass replace=true to rebuild it", req.Name), "name": req.Name, "phase": previous.Phase})
+		return
+	case errors.Is(err, ErrBlueprintInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("blueprint %s is used by VMs, delete them first", req.Name), "vms": users})
+		return
+	case err != nil:
+		log.Printf("Error storing blueprint %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store blueprint: %v", err)})
+		return
+	}
+	if previous != nil {
+		log.Printf("Rebuilding blueprint %s, which was %s", req.Name, previous.Phase)
+	}
+
+	job, err := api.jobs.Submit("blueprint", owner, blueprintPhases, func(run *JobRun) (gin.H, error) {
+		return api.runBuildBlueprint(run, req.Name)
+	})
+	if err != nil {
+		// A blueprint that was ready before stays ready
+		if restoreErr := api.registry.RestoreBlueprint(req.Name, previous); restoreErr != nil {
+			log.Printf("Error restoring blueprint %s: %v", req.Name, restoreErr)
+		}
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrVMBusy):
+			status = http.StatusConflict
+		case errors.Is(err, ErrJobQueueFull):
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Blueprint build queued",
+		"name":       req.Name,
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+	})
+}
+
+func (api *DrafterAPI) listBlueprints(c *gin.Context) {
+	bps, err := api.registry.ListBlueprints()
+	if err != nil {
+		log.Printf("Error listing blueprints: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list blueprints: %v", err)})
+		return
+	}
+	sort.Slice(bps, func(i, j int) bool { return bps[i].Name < bps[j].Name })
+	if bps == nil {
+		bps = []*Blueprint{}
+	}
+	c.JSON(http.StatusOK, gin.H{"blueprints": bps})
+}
+
+func (api *DrafterAPI) getBlueprint(c *gin.Context) {
+	name := c.Param("name")
+	bp, err := api.registry.GetBlueprint(name)
+	if errors.Is(err, ErrBlueprintNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blueprint %s not found", name)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading blueprint %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read blueprint: %v", err)})
+		return
+	}
+
+	users, err := api.registry.BlueprintUsers(name)
+	if err != nil {
+		log.Printf("Error listing VMs of blueprint %s: %v", name, err)
+	}
+	if users == nil {
+		users = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"blueprint": bp, "vms": users})
+}
+
+// failBlueprint records a failed build and gives back its namespace
+func (api *DrafterAPI) failBlueprint(name string, cause error) {
+	if _, err := api.registry.UpdateBlueprint(name, func(bp *Blueprint) error {
+		bp.Phase = BlueprintFailed
+		bp.Error = cause.Error()
+		bp.Netns = ""
+		return nil
+	}); err != nil {
+		log.Printf("Error marking blueprint %s as failed: %v", name, err)
+	}
+}
+
+// runBuildBlueprint downloads and extracts the release artifacts and
+// snapshots them into the blueprint's package
+func (api *DrafterAPI) runBuildBlueprint(run *JobRun, name string) (result gin.H, err error) {
+	bp, err := api.registry.GetBlueprint(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blueprint: %v", err)
+	}
+	owner := blueprintOwner(name)
+
+	defer func() {
+		if err != nil {
+			api.failBlueprint(name, err)
+		}
+	}()
+
+	run.Phase("prepare")
+	logManager, err := api.setupLogging(owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup logging: %v", err)
+	}
+	defer logManager.Close()
+
+	if _, err := api.registry.UpdateBlueprint(name, func(bp *Blueprint) error {
+		bp.LogsPath = logManager.baseDir
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update blueprint: %v", err)
+	}
+
+	if err := os.RemoveAll(bp.Dir); err != nil {
+		log.Printf("Error cleaning up blueprint %s: %v", name, err)
+	}
+	for _, dir := range []string{bp.BlueprintDir, bp.PackageDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+		}
+	}
+	if err := api.config.chownToServiceUser(bp.Dir); err != nil {
+		return nil, fmt.Errorf("failed to set permissions: %v", err)
+	}
+	if err := prepareHost(); err != nil {
+		return nil, err
+	}
+
+	opts, err := bp.PackageSpec.Resolve(api.config.Artifacts.defaultWorkload())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := api.fetchArtifacts(run, bp.Dir, bp.BlueprintDir, opts.Workload); err != nil {
+		return nil, err
+	}
+	if opts.DiskSize > 0 {
+		if err := growDisks(run, bp.BlueprintDir, opts.DiskSize); err != nil {
+			return nil, err
+		}
+	}
+
+	run.Phase("nat")
+	if err := api.ensureNAT(logManager); err != nil {
+		return nil, fmt.Errorf("failed to start NAT service: %v", err)
+	}
+	netns, err := api.netns.AcquireBlueprint(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate network namespace: %v", err)
+	}
+
+	run.Phase("snapshot")
+	status, err := api.runSnapshotter(run, owner, netns, opts, bp.BlueprintDir, bp.PackageDir, logManager)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Phase("verify")
+	sizes, err := api.finishBlueprint(name, status)
+	if err != nil {
+		logSnapshotError(logManager, err)
+		return gin.H{"name": name, "files": sizes}, err
+	}
+
+	log.Printf("Blueprint built successfully: %s", name)
+	return gin.H{
+		"message":   "Blueprint built",
+		"name":      name,
+		"phase":     BlueprintReady,
+		"files":     sizes,
+		"logs_path": logManager.baseDir,
+	}, nil
+}
+
+// finishBlueprint checks the blueprint's package, marks it ready and gives
+// back its namespace
+func (api *DrafterAPI) finishBlueprint(name string, status ProcessStatus) (map[string]int64, error) {
+	bp, err := api.registry.GetBlueprint(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blueprint: %v", err)
+	}
+
+	sizes, config, err := checkSnapshot(bp.PackageDir, bp.PackageSpec.cpuTemplate(), status)
+	if err != nil {
+		return sizes, err
+	}
+
+	if _, err := api.registry.UpdateBlueprint(name, func(bp *Blueprint) error {
+		bp.Phase = BlueprintReady
+		bp.Error = ""
+		bp.Netns = ""
+		bp.Files = sizes
+		bp.PackageConfig = config
+		return nil
+	}); err != nil {
+		return sizes, fmt.Errorf("failed to update blueprint: %v", err)
+	}
+	return sizes, nil
+}
+
+// finishAdoptedBlueprint finishes a build whose snapshotter was adopted
+// after an API restart and has now exited
+func (api *DrafterAPI) finishAdoptedBlueprint(name string, status ProcessStatus) {
+	bp, err := api.registry.GetBlueprint(name)
+	if err != nil || bp.Phase != BlueprintBuilding {
+		return
+	}
+	if _, err := api.finishBlueprint(name, status); err != nil {
+		log.Printf("Snapshot of blueprint %s failed: %v", name, err)
+		api.failBlueprint(name, err)
+		return
+	}
+	log.Printf("Blueprint built successfully: %s", name)
+}
+
+// readyBlueprint looks up the blueprint a create request names and fills in
+// the spec it was built from, which the snapshot fixed
+func (api *DrafterAPI) readyBlueprint(c *gin.Context, config *VMConfig) (*Blueprint, bool) {
+	bp, err := api.registry.GetBlueprint(config.Blueprint)
+	if errors.Is(err, ErrBlueprintNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blueprint %s not found", config.Blueprint)})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading blueprint %s: %v", config.Blueprint, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read blueprint: %v", err)})
+		return nil, false
+	}
+	if bp.Phase != BlueprintReady {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("blueprint %s is %s, not ready", bp.Name, bp.Phase), "blueprint": bp.Name, "phase": bp.Phase})
+		return nil, false
+	}
+
+	if mismatches, err := config.PackageSpec.mismatches(bp.PackageSpec, api.config.Artifacts.defaultWorkload()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	} else if len(mismatches) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("blueprint %s was built with different %s, which cannot be changed", bp.Name, strings.Join(mismatches, ", ")), "blueprint": bp.PackageSpec})
+		return nil, false
+	}
+	config.PackageSpec = bp.PackageSpec
+	return bp, true
+}
+
+// useBlueprint points a VM at a blueprint's package. Like a clone, the VM
+// has its own instance tree and only reads the package.
+func useBlueprint(rec *VMRecord, bp *Blueprint) {
+	rec.BlueprintDir = ""
+	rec.PackageDir = bp.PackageDir
+	rec.PackageConfig = bp.PackageConfig
+}
+
+// runCreateFromBlueprint gives a VM its instance directories, after which
+// it is ready to start
+func (api *DrafterAPI) runCreateFromBlueprint(run *JobRun, name string) (gin.H, error) {
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	run.Phase("prepare")
+	// A replaced VM may have left its own package behind
+	if err := os.RemoveAll(record.BaseDir); err != nil {
+		log.Printf("Error cleaning up existing directories: %v", err)
+	}
+	if err := api.prepareInstance(record); err != nil {
+		return nil, err
+	}
+
+	log.Printf("VM created from blueprint %s: %s", record.Config.Blueprint, name)
+	return gin.H{
+		"message":   "VM created",
+		"name":      name,
+		"phase":     PhaseReady,
+		"blueprint": record.Config.Blueprint,
+	}, nil
+}
+
+// adoptBlueprintSnapshotter supervises the snapshotter of a blueprint build
+// left running by an earlier run of the API, which finishes the build when
+// it exits. The snapshotter of a blueprint that is not building anymore is
+// stopped, so it does not hold on to a netns.
+func (api *DrafterAPI) adoptBlueprintSnapshotter(proc *drafterProcess, name string) bool {
+	if proc.Component != "snapshotter" {
+		log.Printf("Reconcile: %s (pid %d) of blueprint %s is not a snapshotter", proc.Component, proc.PID, name)
+		return false
+	}
+
+	bp, err := api.registry.GetBlueprint(name)
+	if err != nil || bp.Phase != BlueprintBuilding {
+		reason := "is not building"
+		if err != nil {
+			reason = fmt.Sprintf("cannot be read (%v)", err)
+		}
+		result := stopPID(proc.Component, proc.PID, api.config.StopGracePeriod)
+		log.Printf("Reconcile: stopped snapshotter (pid %d) of blueprint %s, which %s: %s", proc.PID, name, reason, result.Outcome)
+		return false
+	}
+
+	logPath := ""
+	if bp.LogsPath != "" {
+		logPath = filepath.Join(bp.LogsPath, "snapshotter.log")
+	}
+	return api.adopt(proc, blueprintOwner(name), logPath)
+}
+
+// reconcileBlueprints fails blueprint builds that an API restart cut short,
+// unless their snapshotter was adopted and is still building the package
+func (api *DrafterAPI) reconcileBlueprints(adopted map[string]bool) error {
+	bps, err := api.registry.ListBlueprints()
+	if err != nil {
+		return fmt.Errorf("failed to list blueprints: %v", err)
+	}
+	for _, bp := range bps {
+		if bp.Phase != BlueprintBuilding {
+			continue
+		}
+		if adopted[bp.Name] {
+			log.Printf("Reconcile: adopted snapshotter of blueprint %s", bp.Name)
+			continue
+		}
+		api.failBlueprint(bp.Name, errors.New("interrupted by API restart"))
+		log.Printf("Reconcile: marked blueprint %s as failed: interrupted by API restart", bp.Name)
+	}
+	return nil
+}
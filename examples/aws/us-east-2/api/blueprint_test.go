@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReplaceBlueprint(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	ready := &Blueprint{Name: "base", Phase: BlueprintReady, PackageSpec: PackageSpec{Memory: "1G"}}
+	if previous, _, err := reg.ReplaceBlueprint(ready, false); err != nil || previous != nil {
+		t.Fatalf("ReplaceBlueprint() of a new blueprint = %v, %v", previous, err)
+	}
+	for name, phase := range map[string]string{"vm-1": PhaseRunning, "vm-gone": PhaseDeleted} {
+		if err := reg.Put(&VMRecord{Name: name, Phase: phase, Config: VMConfig{Blueprint: "base"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rebuild := func() *Blueprint {
+		return &Blueprint{Name: "base", Phase: BlueprintBuilding, PackageSpec: PackageSpec{Memory: "2G"}}
+	}
+	if previous, _, err := reg.ReplaceBlueprint(rebuild(), false); !errors.Is(err, ErrBlueprintExists) || previous == nil || previous.Phase != BlueprintReady {
+		t.Errorf("ReplaceBlueprint() without replace = %v, %v, want ErrBlueprintExists and the ready blueprint", previous, err)
+	}
+	_, users, err := reg.ReplaceBlueprint(rebuild(), true)
+	if !errors.Is(err, ErrBlueprintInUse) || !reflect.DeepEqual(users, []string{"vm-1"}) {
+		t.Errorf("ReplaceBlueprint() in use = %v, %v, want ErrBlueprintInUse with vm-1", users, err)
+	}
+	if bp, err := reg.GetBlueprint("base"); err != nil || bp.Phase != BlueprintReady || bp.Memory != "1G" {
+		t.Errorf("GetBlueprint(base) = %+v, %v, a refused rebuild changed it", bp, err)
+	}
+
+	if _, err := reg.Transition("vm-1", PhaseDeleted, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	previous, _, err := reg.ReplaceBlueprint(rebuild(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp, err := reg.GetBlueprint("base"); err != nil || bp.Phase != BlueprintBuilding || bp.Memory != "2G" {
+		t.Errorf("GetBlueprint(base) = %+v, %v, want the rebuild", bp, err)
+	}
+
+	// A rebuild that could not be queued puts the ready blueprint back
+	if err := reg.RestoreBlueprint("base", previous); err != nil {
+		t.Fatal(err)
+	}
+	if bp, err := reg.GetBlueprint("base"); err != nil || bp.Phase != BlueprintReady || bp.Memory != "1G" {
+		t.Errorf("GetBlueprint(base) = %+v, %v, want the ready blueprint back", bp, err)
+	}
+}
+
+func TestCreateBlueprintQueueFull(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	if _, _, err := reg.ReplaceBlueprint(&Blueprint{Name: "base", Phase: BlueprintReady}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg, jobs: NewJobManager(reg, 0)}
+	router.POST("/blueprints", api.createBlueprint)
+	for i := 0; i < jobQueueSize; i++ {
+		if _, err := api.jobs.Submit("start", fmt.Sprintf("filler-%d", i), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/blueprints?replace=true", strings.NewReader(`{"name": "base"}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("rebuild with a full queue returned %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body.String())
+	}
+	if bp, err := reg.GetBlueprint("base"); err != nil || bp.Phase != BlueprintReady {
+		t.Errorf("GetBlueprint(base) = %+v, %v, the ready blueprint was not kept", bp, err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+var clonePhases = []string{"prepare", "network", "peer", "forwarder"}
+
+// cloneRequest is the body of POST /vm/:name/clone
+type cloneRequest struct {
+	Count  int               `json:"count"`
+	Prefix string            `json:"prefix"`
+	Labels map[string]string `json:"labels"`
+}
+
+// hasPackage reports whether a VM has a verified package to start from
+func hasPackage(rec *VMRecord) bool {
+	switch rec.Phase {
+	case PhaseReady, PhaseStarting, PhaseRunning, PhaseMigratingOut, PhaseStopped:
+		return true
+	}
+	return false
+}
+
+// clonesOf returns the VMs started from a VM's package that still exist
+func (api *DrafterAPI) clonesOf(name string) ([]string, error) {
+	records, err := api.registry.List()
+	if err != nil {
+		return nil, err
+	}
+	var clones []string
+	for _, rec := range records {
+		if rec.Source == name && rec.Phase != PhaseDeleted {
+			clones = append(clones, rec.Name)
+		}
+	}
+	sort.Strings(clones)
+	return clones, nil
+}
+
+// checkNoClones rejects removing a VM's package while clones run from it
+func (api *DrafterAPI) checkNoClones(c *gin.Context, name string) bool {
+	clones, err := api.clonesOf(name)
+	if err != nil {
+		log.Printf("Error listing clones of VM %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list VMs: %v", err)})
+		return false
+	}
+	if len(clones) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s has clones running from its package, delete them first", name), "clones": clones})
+		return false
+	}
+	return true
+}
+
+// cloneNames picks count unused names of the form <prefix>-<n>
+func cloneNames(prefix string, count int, records []*VMRecord) ([]string, error) {
+	used := make(map[string]bool, len(records))
+	for _, rec := range records {
+		used[rec.Name] = true
+	}
+
+	var names []string
+	for i := 1; len(names) < count; i++ {
+		name := fmt.Sprintf("%s-%d", prefix, i)
+		if err := validateVMName(name); err != nil {
+			return nil, err
+		}
+		if !used[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (api *DrafterAPI) cloneVM(c *gin.Context) {
+	name := c.Param("name")
+	source, ok := api.lookupVM(c, name)
+	if !ok {
+		return
+	}
+
+	// The body is optional and defaults to a single clone
+	request := cloneRequest{Count: 1, Prefix: name + "-clone"}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			log.Printf("Error parsing clone request: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Count < 1 || request.Count > api.config.NetnsPoolSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", api.config.NetnsPoolSize)})
+		return
+	}
+	if !hasPackage(source) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s is %s and has no package to clone", name, source.Phase), "name": name, "phase": source.Phase})
+		return
+	}
+
+	records, err := api.registry.List()
+	if err != nil {
+		log.Printf("Error listing VMs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list VMs: %v", err)})
+		return
+	}
+	names, err := cloneNames(request.Prefix, request.Count, records)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid prefix: %v", err)})
+		return
+	}
+
+	clones := make([]gin.H, 0, len(names))
+	var firstErr error
+	failed := 0
+	for _, cloneName := range names {
+		entry := gin.H{"name": cloneName}
+		clones = append(clones, entry)
+
+		job, err := api.createClone(source, cloneName, request.Labels)
+		if err != nil {
+			log.Printf("Error cloning VM %s as %s: %v", name, cloneName, err)
+			entry["error"] = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		entry["job_id"] = job.ID
+		entry["status_url"] = "/jobs/" + job.ID
+	}
+
+	if failed == len(names) {
+		c.JSON(cloneErrorStatus(firstErr), gin.H{
+			"error":  fmt.Sprintf("no clone of VM %s could be queued: %v", name, firstErr),
+			"source": name,
+			"failed": failed,
+			"clones": clones,
+		})
+		return
+	}
+
+	status, message := http.StatusAccepted, "VM clone queued"
+	if failed > 0 {
+		status, message = http.StatusMultiStatus, fmt.Sprintf("%d of %d VM clones queued", len(names)-failed, len(names))
+	}
+	c.JSON(status, gin.H{
+		"message": message,
+		"source":  name,
+		"failed":  failed,
+		"clones":  clones,
+	})
+}
+
+// cloneErrorStatus is the status of a clone request none of whose clones
+// could be queued
+func cloneErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrVMExists), errors.Is(err, ErrVMBusy):
+		return http.StatusConflict
+	case errors.Is(err, ErrJobQueueFull):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// createClone registers a clone of source and queues the job that starts it
+func (api *DrafterAPI) createClone(source *VMRecord, name string, labels map[string]string) (*Job, error) {
+	config := source.Config
+	config.Name = name
+	config.Labels = make(map[string]string, len(source.Config.Labels)+len(labels))
+	for k, v := range source.Config.Labels {
+		config.Labels[k] = v
+	}
+	for k, v := range labels {
+		config.Labels[k] = v
+	}
+
+	// The clone has its own instance tree but runs from the source's
+	// package, which the peer only ever reads. A clone of a clone runs from
+	// the original's package, so the original is its source: that is the
+	// VM whose deletion would remove the package.
+	owner := source.Name
+	if source.Source != "" {
+		owner = source.Source
+	}
+	record := &VMRecord{Name: name, Config: config, Source: owner, PackageConfig: source.PackageConfig}
+	api.config.setVMPaths(record)
+	record.BlueprintDir = ""
+	record.PackageDir = source.PackageDir
+	if err := record.transition(PhaseCreating, nil); err != nil {
+		return nil, err
+	}
+	if err := api.registry.Create(record); err != nil {
+		return nil, fmt.Errorf("failed to register clone: %w", err)
+	}
+
+	job, err := api.jobs.Submit("clone", name, clonePhases, func(run *JobRun) (gin.H, error) {
+		return api.runClone(run, name)
+	})
+	if err != nil {
+		api.restoreVM(name, PhaseCreating, nil)
+		return nil, err
+	}
+	return job, nil
+}
+
+func (api *DrafterAPI) runClone(run *JobRun, name string) (gin.H, error) {
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	run.Phase("prepare")
+	if err := api.prepareInstance(record); err != nil {
+		return nil, err
+	}
+	if _, err := api.registry.Transition(name, PhaseStarting, nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
+	}
+
+	result, err := api.runStart(run, name)
+	if result != nil {
+		result["source"] = record.Source
+	}
+	return result, err
+}
+
+// prepareInstance creates the instance tree of a VM that runs from a package
+// it does not own, and marks the VM ready
+func (api *DrafterAPI) prepareInstance(record *VMRecord) error {
+	for _, dir := range []string{record.OverlayDir, record.StateDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			err = fmt.Errorf("failed to create directory %s: %v", dir, err)
+			api.failVM(record.Name, err)
+			return err
+		}
+	}
+
+	if _, err := api.registry.Transition(record.Name, PhaseReady, nil, nil); err != nil {
+		return fmt.Errorf("failed to update VM record: %v", err)
+	}
+	return nil
+}
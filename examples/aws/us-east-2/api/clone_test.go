@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCloneNames(t *testing.T) {
+	records := []*VMRecord{{Name: "web-1"}, {Name: "web-3"}}
+	names, err := cloneNames("web", 3, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web-2", "web-4", "web-5"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("cloneNames() = %v, want %v", names, want)
+	}
+
+	if _, err := cloneNames("not valid", 1, nil); err == nil {
+		t.Error("cloneNames() accepted a prefix that makes invalid names")
+	}
+}
+
+type cloneResponse struct {
+	Error  string  `json:"error"`
+	Failed int     `json:"failed"`
+	Clones []gin.H `json:"clones"`
+}
+
+func TestCloneVM(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	for name, phase := range map[string]string{"src": PhaseReady, "new": PhaseCreating} {
+		if err := reg.Put(&VMRecord{Name: name, Phase: phase, PackageDir: "/data/" + name + "/package"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without workers the queued clones stay queued
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg, jobs: NewJobManager(reg, 0)}
+	router.POST("/vm/:name/clone", api.cloneVM)
+	clone := func(name, body string) (int, cloneResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/vm/"+name+"/clone", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var resp cloneResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		return w.Code, resp
+	}
+
+	if code, _ := clone("new", ""); code != http.StatusConflict {
+		t.Errorf("cloning a VM without a package returned %d, want %d", code, http.StatusConflict)
+	}
+	if code, _ := clone("src", `{"count": 0}`); code != http.StatusBadRequest {
+		t.Errorf("count 0 returned %d, want %d", code, http.StatusBadRequest)
+	}
+
+	code, resp := clone("src", `{"count": 2, "labels": {"tier": "web"}}`)
+	if code != http.StatusAccepted || resp.Failed != 0 || len(resp.Clones) != 2 {
+		t.Fatalf("clone returned %d with %+v, want 2 queued clones", code, resp)
+	}
+	rec, err := reg.Get("src-clone-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhaseCreating || rec.Source != "src" || rec.PackageDir != "/data/src/package" || rec.Config.Labels["tier"] != "web" {
+		t.Errorf("clone record = %+v, want a creating clone of src running from its package", rec)
+	}
+
+	// Leave room on the queue for a single job
+	for i := len(resp.Clones); i < jobQueueSize-1; i++ {
+		if _, err := api.jobs.Submit("start", fmt.Sprintf("filler-%d", i), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code, resp = clone("src", `{"count": 2}`)
+	if code != http.StatusMultiStatus || resp.Failed != 1 {
+		t.Errorf("partly queued clone returned %d with %d failed, want %d with 1 failed", code, resp.Failed, http.StatusMultiStatus)
+	}
+	// The clone that could not be queued is not left behind
+	if _, err := reg.Get("src-clone-4"); err == nil {
+		t.Error("the clone that was not queued was kept")
+	}
+
+	code, resp = clone("src", "")
+	if code != http.StatusServiceUnavailable || resp.Failed != 1 || resp.Error == "" {
+		t.Errorf("clone with a full queue returned %d with %+v, want %d", code, resp, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings that can be tuned at startup. Every
+// setting can come from the config file (under its yaml key), an environment
+// variable or a flag, see LoadConfig.
+type Config struct {
+	// DataRoot holds the VM, blueprint and workload trees and LogRoot their
+	// logs. ServiceUser owns the trees, as user or user:group.
+	DataRoot    string `yaml:"data_root"`
+	LogRoot     string `yaml:"log_root"`
+	ServiceUser string `yaml:"service_user"`
+
+	// ListenAddr is the address the API serves on
+	ListenAddr string `yaml:"listen"`
+	// HostInterface is the interface drafter-nat routes the VMs through, by
+	// default the one of the default route
+	HostInterface string `yaml:"host_interface"`
+	// hostInterfaceDetected is set when HostInterface came from the route
+	hostInterfaceDetected bool
+
+	RegistryPath  string `yaml:"registry"`
+	NetnsPrefix   string `yaml:"netns_prefix"`
+	NetnsPoolSize int    `yaml:"netns_pool_size"`
+
+	ForwardHost      string `yaml:"forward_host"`
+	ForwardPortStart int    `yaml:"forward_port_start"`
+	ForwardPortEnd   int    `yaml:"forward_port_end"`
+	PeerPortStart    int    `yaml:"peer_port_start"`
+
+	JobWorkers int `yaml:"job_workers"`
+	// JobRetention is how long finished jobs are kept, checked at startup
+	JobRetention time.Duration `yaml:"job_retention"`
+
+	// StopGracePeriod is how long stop waits after SIGTERM before SIGKILL
+	StopGracePeriod time.Duration `yaml:"stop_grace_period"`
+
+	// SnapshotTimeout is how long drafter-snapshotter may run for
+	SnapshotTimeout time.Duration `yaml:"snapshot_timeout"`
+
+	// How long to wait for each component to become ready after starting it
+	NATReadyTimeout       time.Duration `yaml:"nat_ready_timeout"`
+	PeerReadyTimeout      time.Duration `yaml:"peer_ready_timeout"`
+	ForwarderReadyTimeout time.Duration `yaml:"forwarder_ready_timeout"`
+
+	// RestartPolicies maps a drafter component to its supervisor restart policy
+	RestartPolicies map[string]RestartPolicy `yaml:"restart_policies"`
+
+	// Artifacts is where DrafterOS and the default workload come from
+	Artifacts ArtifactSource `yaml:"artifacts"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DataRoot:    defaultDataRoot,
+		LogRoot:     defaultLogRoot,
+		ServiceUser: defaultServiceUser,
+		ListenAddr:  ":8080",
+
+		// RegistryPath is left empty to follow LogRoot, see LoadConfig
+		NetnsPrefix:   "ark",
+		NetnsPoolSize: 32,
+
+		ForwardHost:      "127.0.0.1",
+		ForwardPortStart: 3333,
+		ForwardPortEnd:   3432,
+		PeerPortStart:    1337,
+
+		JobWorkers:      4,
+		JobRetention:    7 * 24 * time.Hour,
+		StopGracePeriod: 30 * time.Second,
+
+		SnapshotTimeout: 30 * time.Minute,
+
+		NATReadyTimeout:       30 * time.Second,
+		PeerReadyTimeout:      5 * time.Minute,
+		ForwarderReadyTimeout: 30 * time.Second,
+
+		RestartPolicies: map[string]RestartPolicy{
+			"nat":         RestartOnFailure,
+			"snapshotter": RestartNever,
+			"peer":        RestartNever,
+			"forwarder":   RestartOnFailure,
+		},
+
+		Artifacts: defaultArtifactSource(),
+	}
+}
+
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.DataRoot, "data-root", cfg.DataRoot, "Directory holding the VM, blueprint and workload trees")
+	fs.StringVar(&cfg.LogRoot, "log-root", cfg.LogRoot, "Directory holding the VM and drafter logs")
+	fs.StringVar(&cfg.ServiceUser, "service-user", cfg.ServiceUser, "User, or user:group, that owns the VM trees")
+	fs.StringVar(&cfg.ListenAddr, "listen", cfg.ListenAddr, "Address the API listens on")
+	fs.StringVar(&cfg.HostInterface, "host-interface", cfg.HostInterface, "Host network interface drafter-nat routes VM traffic through (default the default route's interface)")
+	fs.StringVar(&cfg.RegistryPath, "registry", cfg.RegistryPath, "Path to the VM registry database (default registry.db next to the log root)")
+	fs.StringVar(&cfg.NetnsPrefix, "netns-prefix", cfg.NetnsPrefix, "Prefix of the network namespaces created by drafter-nat")
+	fs.IntVar(&cfg.NetnsPoolSize, "netns-pool-size", cfg.NetnsPoolSize, "Number of network namespaces to hand out to VMs")
+	fs.StringVar(&cfg.ForwardHost, "forward-host", cfg.ForwardHost, "Host address drafter-forwarder binds forwarded ports on")
+	fs.IntVar(&cfg.ForwardPortStart, "forward-port-start", cfg.ForwardPortStart, "First host port handed out to drafter-forwarder")
+	fs.IntVar(&cfg.ForwardPortEnd, "forward-port-end", cfg.ForwardPortEnd, "Last host port handed out to drafter-forwarder")
+	fs.IntVar(&cfg.PeerPortStart, "peer-port-start", cfg.PeerPortStart, "First host port drafter-peer listens on for migrations")
+	fs.IntVar(&cfg.JobWorkers, "job-workers", cfg.JobWorkers, "Number of VM operations run in parallel")
+	fs.DurationVar(&cfg.JobRetention, "job-retention", cfg.JobRetention, "How long finished jobs can still be looked up, pruned at startup")
+	fs.DurationVar(&cfg.StopGracePeriod, "stop-grace-period", cfg.StopGracePeriod, "How long to wait after SIGTERM before killing a VM's processes")
+	fs.DurationVar(&cfg.SnapshotTimeout, "snapshot-timeout", cfg.SnapshotTimeout, "How long drafter-snapshotter may take to build a VM's package")
+	fs.DurationVar(&cfg.NATReadyTimeout, "nat-ready-timeout", cfg.NATReadyTimeout, "How long to wait for drafter-nat to set up its namespaces")
+	fs.DurationVar(&cfg.PeerReadyTimeout, "peer-ready-timeout", cfg.PeerReadyTimeout, "How long to wait for drafter-peer to resume or migrate a VM")
+	fs.DurationVar(&cfg.ForwarderReadyTimeout, "forwarder-ready-timeout", cfg.ForwarderReadyTimeout, "How long to wait for drafter-forwarder to accept connections")
+	fs.Var(restartPoliciesFlag(cfg.RestartPolicies), "restart-policy", "Comma-separated component=policy restart policies, e.g. forwarder=always,peer=on-failure")
+	fs.StringVar(&cfg.Artifacts.Version, "drafter-version", cfg.Artifacts.Version, "Drafter release the artifacts are downloaded from, which the drafter binaries must match")
+	fs.StringVar(&cfg.Artifacts.BaseURL, "artifact-base-url", cfg.Artifacts.BaseURL, "Base URL of the drafter releases or a mirror of them, which holds <version>/<file>")
+	fs.Var(artifactsFlag(cfg.Artifacts.Overrides), "artifact", "Comma-separated artifact=url-or-path overrides, e.g. drafteros=/srv/drafteros-oci-x86_64_pvm.tar.zst")
+	fs.StringVar(&cfg.Artifacts.BinDir, "drafter-bin-dir", cfg.Artifacts.BinDir, "Directory the drafter binaries are run from")
+	fs.BoolVar(&cfg.Artifacts.SkipVersionCheck, "skip-drafter-version-check", cfg.Artifacts.SkipVersionCheck, "Build packages even when the release of the drafter binaries cannot be told")
+}
+
+func (cfg Config) Validate() error {
+	for name, dir := range map[string]string{"data root": cfg.DataRoot, "log root": cfg.LogRoot} {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("%s must be an absolute path, got %q", name, dir)
+		}
+	}
+	if name, _, _ := strings.Cut(cfg.ServiceUser, ":"); name == "" {
+		return fmt.Errorf("service user must not be empty")
+	}
+	if cfg.RegistryPath == "" {
+		return fmt.Errorf("registry path must not be empty")
+	}
+	if cfg.NetnsPrefix == "" {
+		return fmt.Errorf("netns prefix must not be empty")
+	}
+	if cfg.NetnsPoolSize < 1 {
+		return fmt.Errorf("netns pool size must be at least 1, got %d", cfg.NetnsPoolSize)
+	}
+	if net.ParseIP(cfg.ForwardHost) == nil {
+		return fmt.Errorf("forward host must be an IP address, got %q", cfg.ForwardHost)
+	}
+	if cfg.ForwardPortStart < 1 || cfg.ForwardPortEnd > 65535 || cfg.ForwardPortStart > cfg.ForwardPortEnd {
+		return fmt.Errorf("invalid forward port range %d-%d", cfg.ForwardPortStart, cfg.ForwardPortEnd)
+	}
+	peerPortEnd := cfg.PeerPortStart + cfg.NetnsPoolSize - 1
+	if cfg.PeerPortStart < 1 || peerPortEnd > 65535 {
+		return fmt.Errorf("invalid peer port start %d for a pool of %d VMs", cfg.PeerPortStart, cfg.NetnsPoolSize)
+	}
+	if cfg.PeerPortStart <= cfg.ForwardPortEnd && peerPortEnd >= cfg.ForwardPortStart {
+		return fmt.Errorf("peer ports %d-%d overlap forward ports %d-%d", cfg.PeerPortStart, peerPortEnd, cfg.ForwardPortStart, cfg.ForwardPortEnd)
+	}
+	host, port, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", cfg.ListenAddr, err)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("listen address %q must have an IP address, got %q", cfg.ListenAddr, host)
+	}
+	listenPort, err := strconv.Atoi(port)
+	if err != nil || listenPort < 1 || listenPort > 65535 {
+		return fmt.Errorf("listen address %q has an invalid port", cfg.ListenAddr)
+	}
+	if listenPort >= cfg.ForwardPortStart && listenPort <= cfg.ForwardPortEnd || listenPort >= cfg.PeerPortStart && listenPort <= peerPortEnd {
+		return fmt.Errorf("listen port %d is in the forward or peer port range", listenPort)
+	}
+	if cfg.JobWorkers < 1 {
+		return fmt.Errorf("job workers must be at least 1, got %d", cfg.JobWorkers)
+	}
+	// An Idempotency-Key replays its job, which has to outlive the key
+	if cfg.JobRetention < idempotencyKeyTTL {
+		return fmt.Errorf("job retention must be at least %s, got %s", idempotencyKeyTTL, cfg.JobRetention)
+	}
+	if cfg.StopGracePeriod < 0 {
+		return fmt.Errorf("stop grace period must not be negative, got %s", cfg.StopGracePeriod)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"snapshot timeout":        cfg.SnapshotTimeout,
+		"nat ready timeout":       cfg.NATReadyTimeout,
+		"peer ready timeout":      cfg.PeerReadyTimeout,
+		"forwarder ready timeout": cfg.ForwarderReadyTimeout,
+	} {
+		if timeout <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", name, timeout)
+		}
+	}
+	for component, policy := range cfg.RestartPolicies {
+		if _, err := ParseRestartPolicy(string(policy)); err != nil {
+			return fmt.Errorf("restart policy of %s: %v", component, err)
+		}
+	}
+	return cfg.Artifacts.validate()
+}
+
+// listenPort is the port the API listens on, which other hosts' APIs are
+// assumed to listen on too
+func (cfg Config) listenPort() string {
+	_, port, _ := net.SplitHostPort(cfg.ListenAddr)
+	return port
+}
+
+// checkHost fills in the host interface from the default route if none is
+// configured, and checks that the interface and the service user exist on
+// this host. It is kept out of Validate so loading a config does not depend
+// on the host it is loaded on.
+func (cfg *Config) checkHost() error {
+	if err := cfg.resolveHostInterface(); err != nil {
+		return err
+	}
+	if _, err := net.InterfaceByName(cfg.HostInterface); err != nil {
+		return fmt.Errorf("host interface %q: %v", cfg.HostInterface, err)
+	}
+	return checkServiceUser(cfg.ServiceUser)
+}
+
+// checkServiceUser checks that the user, and group if given, exist
+func checkServiceUser(owner string) error {
+	name, group, hasGroup := strings.Cut(owner, ":")
+	if _, err := user.Lookup(name); err != nil {
+		return fmt.Errorf("service user %q: %v", name, err)
+	}
+	if hasGroup && group != "" {
+		if _, err := user.LookupGroup(group); err != nil {
+			return fmt.Errorf("service group %q: %v", group, err)
+		}
+	}
+	return nil
+}
+
+// envPrefix is prepended to a flag's name, upper-cased with '-' turned into
+// '_', to get its environment variable
+const envPrefix = "DRAFTER_API_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the defaults, the config file
+// (-config or DRAFTER_API_CONFIG), the environment and the command line, each
+// overriding the ones before, and validates it
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := DefaultConfig()
+	path := os.Getenv(envName("config"))
+	fs.StringVar(&path, "config", path, "YAML file with the server settings")
+	cfg.RegisterFlags(fs)
+	// The first pass only finds the config file, the flags are applied again
+	// on top of it below
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid %s %q: %v", envName(f.Name), value, err)
+		}
+	})
+	if envErr != nil {
+		return cfg, envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if cfg.RegistryPath == "" {
+		cfg.RegistryPath = defaultRegistryPath(cfg.LogRoot)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// loadFile applies the settings of a YAML config file. Unknown keys are
+// errors, so a misspelt setting is not silently ignored.
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg Config) restartPolicy(component string) RestartPolicy {
+	if policy, ok := cfg.RestartPolicies[component]; ok {
+		return policy
+	}
+	return RestartNever
+}
+
+// restartPoliciesFlag parses component=policy pairs into the policy map
+type restartPoliciesFlag map[string]RestartPolicy
+
+func (f restartPoliciesFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for component, policy := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", component, policy))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f restartPoliciesFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		component, policy, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || component == "" {
+			return fmt.Errorf("invalid restart policy %q, expected component=policy", pair)
+		}
+		parsed, err := ParseRestartPolicy(policy)
+		if err != nil {
+			return err
+		}
+		f[component] = parsed
+	}
+	return nil
+}
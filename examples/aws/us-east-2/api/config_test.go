@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+data_root: /srv/file/out
+log_root: /srv/file/logs
+service_user: file-user
+netns_pool_size: 8
+stop_grace_period: 45s
+restart_policies:
+  peer: always
+artifacts:
+  version: v0.5.1
+`)
+	t.Setenv(envName("config"), path)
+	t.Setenv(envName("log-root"), "/srv/env/logs")
+	t.Setenv(envName("netns-pool-size"), "16")
+
+	cfg, err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-netns-pool-size", "24",
+		"-restart-policy", "forwarder=always",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{"data root from the file", cfg.DataRoot, "/srv/file/out"},
+		{"log root from the environment over the file", cfg.LogRoot, "/srv/env/logs"},
+		{"registry next to the log root", cfg.RegistryPath, "/srv/env/registry.db"},
+		{"pool size from the flag over the environment", cfg.NetnsPoolSize, 24},
+		{"grace period from the file", cfg.StopGracePeriod, 45 * time.Second},
+		{"version from the file", cfg.Artifacts.Version, "v0.5.1"},
+		{"base url default kept under artifacts", cfg.Artifacts.BaseURL, defaultArtifactSource().BaseURL},
+		{"peer policy from the file", cfg.RestartPolicies["peer"], RestartAlways},
+		{"forwarder policy from the flag", cfg.RestartPolicies["forwarder"], RestartAlways},
+		{"nat policy default kept", cfg.RestartPolicies["nat"], RestartOnFailure},
+		{"default listen address", cfg.ListenAddr, ":8080"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+	// Loading names nothing on the host, the service user is checked at startup
+	if cfg.ServiceUser != "file-user" {
+		t.Errorf("service user = %q, want file-user", cfg.ServiceUser)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown file key", "netns_pool: 8\n", nil, nil, "field netns_pool not found"},
+		{"invalid environment value", "", map[string]string{envName("job-workers"): "many"}, nil, envName("job-workers")},
+		{"relative data root", "", nil, []string{"-data-root", "out"}, "data root must be an absolute path"},
+		{"empty service user", "", nil, []string{"-service-user", ":wheel"}, "service user must not be empty"},
+		{"overlapping ports", "", nil, []string{"-peer-port-start", "3400"}, "overlap forward ports"},
+		{"listen port in a range", "", nil, []string{"-listen", ":3333"}, "forward or peer port range"},
+		{"short job retention", "", nil, []string{"-job-retention", "1h"}, "job retention must be at least"},
+		{"unknown restart policy", "", nil, []string{"-restart-policy", "peer=sometimes"}, "unknown restart policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envName("config"), "")
+			if tt.file != "" {
+				t.Setenv(envName("config"), writeConfigFile(t, tt.file))
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			_, err := LoadConfig(fs, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ServiceUser = "root:root"
+	cfg.HostInterface = "lo"
+	if err := cfg.checkHost(); err != nil {
+		t.Errorf("checkHost() = %v for root on lo", err)
+	}
+
+	cfg.ServiceUser = "drafter-no-such-user"
+	if err := cfg.checkHost(); err == nil || !strings.Contains(err.Error(), "drafter-no-such-user") {
+		t.Errorf("checkHost() = %v for a missing user, want an error naming it", err)
+	}
+
+	cfg.ServiceUser = "root"
+	cfg.HostInterface = "drafter-no-such-if"
+	if err := cfg.checkHost(); err == nil || !strings.Contains(err.Error(), "drafter-no-such-if") {
+		t.Errorf("checkHost() = %v for a missing interface, want an error naming it", err)
+	}
+}
+
+func TestServiceOwner(t *testing.T) {
+	for user, want := range map[string]string{"ec2-user": "ec2-user:", "gcp-user:drafter": "gcp-user:drafter"} {
+		cfg := DefaultConfig()
+		cfg.ServiceUser = user
+		if got := cfg.serviceOwner(); got != want {
+			t.Errorf("serviceOwner() of %q = %q, want %q", user, got, want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	vendorIntel = "intel"
+	vendorAMD   = "amd"
+	vendorARM   = "arm"
+)
+
+// cpuTemplates are the Firecracker CPU templates drafter-snapshotter accepts
+// and the CPU vendor each one needs. A template hides the host CPU's
+// features behind a fixed set, so a VM snapshotted with one can resume on any
+// host whose CPU supports the same template.
+var cpuTemplates = map[string]string{
+	"T2":   vendorIntel,
+	"T2S":  vendorIntel,
+	"T2CL": vendorIntel,
+	"C3":   vendorIntel,
+	"T2A":  vendorAMD,
+	"V1N1": vendorARM,
+}
+
+// defaultCPUTemplates is the template picked for each vendor when a request
+// does not name one
+var defaultCPUTemplates = map[string]string{
+	vendorIntel: "T2",
+	vendorAMD:   "T2A",
+	vendorARM:   "V1N1",
+}
+
+// legacyCPUTemplate is what every package was snapshotted with before the
+// template could be chosen, so records without one were built with it
+const legacyCPUTemplate = "T2A"
+
+// HostCPU is what the API knows about the host's CPU
+type HostCPU struct {
+	Vendor string `json:"vendor"`
+	Model  string `json:"model"`
+	// Err is why the vendor could not be told, if it could not
+	Err string `json:"error,omitempty"`
+}
+
+var (
+	hostCPUOnce sync.Once
+	hostCPUInfo HostCPU
+)
+
+// hostCPU reads /proc/cpuinfo once
+func hostCPU() HostCPU {
+	hostCPUOnce.Do(func() {
+		hostCPUInfo = readCPUInfo("/proc/cpuinfo")
+	})
+	return hostCPUInfo
+}
+
+// readCPUInfo finds the vendor and model of the first CPU in a cpuinfo file
+func readCPUInfo(path string) HostCPU {
+	f, err := os.Open(path)
+	if err != nil {
+		return HostCPU{Err: fmt.Sprintf("failed to read %s: %v", path, err)}
+	}
+	defer f.Close()
+
+	var cpu HostCPU
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Every CPU gets its own block, and the first one is enough
+		if strings.TrimSpace(line) == "" && (cpu.Vendor != "" || cpu.Err != "") {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "vendor_id":
+			switch value {
+			case "GenuineIntel":
+				cpu.Vendor = vendorIntel
+			case "AuthenticAMD":
+				cpu.Vendor = vendorAMD
+			default:
+				cpu.Err = fmt.Sprintf("unsupported CPU vendor %q", value)
+			}
+		case "CPU implementer":
+			if value == "0x41" {
+				cpu.Vendor = vendorARM
+			} else {
+				cpu.Err = fmt.Sprintf("unsupported CPU implementer %s", value)
+			}
+		case "model name":
+			cpu.Model = value
+		}
+	}
+	if cpu.Vendor == "" && cpu.Err == "" {
+		cpu.Err = fmt.Sprintf("no CPU vendor in %s", path)
+	}
+	return cpu
+}
+
+func cpuTemplateNames() string {
+	names := make([]string, 0, len(cpuTemplates))
+	for name := range cpuTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// resolveCPUTemplate checks a requested template against the host, or picks
+// the host's default when none is requested
+func resolveCPUTemplate(template string) (string, error) {
+	cpu := hostCPU()
+	if template == "" {
+		if cpu.Err != "" {
+			return "", fmt.Errorf("cannot pick a CPU template: %s, set cpu_template", cpu.Err)
+		}
+		return defaultCPUTemplates[cpu.Vendor], nil
+	}
+	if err := cpu.supports(template); err != nil {
+		return "", err
+	}
+	return template, nil
+}
+
+// supports checks that a VM snapshotted with a template can run on the host
+func (cpu HostCPU) supports(template string) error {
+	vendor, ok := cpuTemplates[template]
+	if !ok {
+		return fmt.Errorf("unknown CPU template %q, must be one of %s", template, cpuTemplateNames())
+	}
+	if cpu.Err != "" {
+		return fmt.Errorf("cannot check CPU template %s: %s", template, cpu.Err)
+	}
+	if vendor != cpu.Vendor {
+		return fmt.Errorf("CPU template %s needs an %s CPU, this host has an %s CPU (%s)", template, vendor, cpu.Vendor, cpu.Model)
+	}
+	return nil
+}
+
+// cpuTemplateFile sits next to a package's devices and names the CPU
+// template it was snapshotted with
+const cpuTemplateFile = "cpu-template"
+
+// writePackageCPUTemplate records a package's CPU template. The package
+// directory belongs to root, like the snapshotter that fills it.
+func writePackageCPUTemplate(packageDir, template string) error {
+	cmd := exec.Command("sudo", "tee", filepath.Join(packageDir, cpuTemplateFile))
+	cmd.Stdin = strings.NewReader(template + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to record CPU template in %s: %v: %s", packageDir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readPackageCPUTemplate returns the CPU template recorded in a package, or
+// "" when it has none
+func readPackageCPUTemplate(packageDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(packageDir, cpuTemplateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	template := strings.TrimSpace(string(data))
+	if _, ok := cpuTemplates[template]; !ok {
+		return "", fmt.Errorf("unknown CPU template %q in %s", template, packageDir)
+	}
+	return template, nil
+}
+
+// migrationCPUTemplate finds the CPU template of a VM being migrated in: the
+// requested one, the one recorded in a package the VM left on this host, or
+// the one the source's API reports
+func migrationCPUTemplate(rec *VMRecord, requested string, source *migrationSource) (string, error) {
+	if requested != "" {
+		return requested, nil
+	}
+	if template, err := readPackageCPUTemplate(rec.PackageDir); err != nil {
+		return "", err
+	} else if template != "" {
+		return template, nil
+	}
+	status, err := source.Status()
+	if err != nil {
+		return "", err
+	}
+	if status.CPUTemplate == "" {
+		return "", fmt.Errorf("%s does not report a CPU template", source.api)
+	}
+	return status.CPUTemplate, nil
+}
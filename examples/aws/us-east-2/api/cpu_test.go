@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCPUInfo(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cpuinfo")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadCPUInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuinfo string
+		want    HostCPU
+	}{
+		{
+			"intel",
+			"processor\t: 0\nvendor_id\t: GenuineIntel\nmodel name\t: Intel(R) Xeon(R) Platinum 8375C CPU @ 2.90GHz\n\n" +
+				"processor\t: 1\nvendor_id\t: GenuineIntel\nmodel name\t: Intel(R) Xeon(R) Platinum 8375C CPU @ 2.90GHz\n",
+			HostCPU{Vendor: vendorIntel, Model: "Intel(R) Xeon(R) Platinum 8375C CPU @ 2.90GHz"},
+		},
+		{
+			"amd",
+			"processor\t: 0\nvendor_id\t: AuthenticAMD\nmodel name\t: AMD EPYC 7R13 Processor\n",
+			HostCPU{Vendor: vendorAMD, Model: "AMD EPYC 7R13 Processor"},
+		},
+		{
+			"arm",
+			"processor\t: 0\nBogoMIPS\t: 243.75\nCPU implementer\t: 0x41\nCPU part\t: 0xd0c\n",
+			HostCPU{Vendor: vendorARM},
+		},
+		{
+			"unsupported vendor",
+			"processor\t: 0\nvendor_id\t: HygonGenuine\nmodel name\t: Hygon C86 7185\n",
+			HostCPU{Model: "Hygon C86 7185", Err: `unsupported CPU vendor "HygonGenuine"`},
+		},
+		{
+			"unsupported implementer",
+			"processor\t: 0\nCPU implementer\t: 0x61\n",
+			HostCPU{Err: "unsupported CPU implementer 0x61"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readCPUInfo(writeCPUInfo(t, tt.cpuinfo)); got != tt.want {
+				t.Errorf("readCPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCPUInfoWithoutVendor(t *testing.T) {
+	if got := readCPUInfo(writeCPUInfo(t, "processor\t: 0\n")); got.Vendor != "" || got.Err == "" {
+		t.Errorf("readCPUInfo() = %+v, want an error", got)
+	}
+	if got := readCPUInfo(filepath.Join(t.TempDir(), "missing")); got.Err == "" {
+		t.Errorf("readCPUInfo() = %+v, want an error for a missing file", got)
+	}
+}
+
+func TestHostCPUSupports(t *testing.T) {
+	intel := HostCPU{Vendor: vendorIntel, Model: "Xeon"}
+	for _, template := range []string{"T2", "T2S", "T2CL", "C3"} {
+		if err := intel.supports(template); err != nil {
+			t.Errorf("intel.supports(%s) = %v", template, err)
+		}
+	}
+	for _, template := range []string{"T2A", "V1N1", "t2", "X9"} {
+		if err := intel.supports(template); err == nil {
+			t.Errorf("intel.supports(%s) succeeded, want an error", template)
+		}
+	}
+	if err := (HostCPU{Err: "no CPU vendor"}).supports("T2"); err == nil {
+		t.Error("a host of unknown vendor should support no template")
+	}
+}
+
+func TestMigrationCPUTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name": "vm", "cpu_template": "T2S"}`)
+	}))
+	defer server.Close()
+	source := &migrationSource{api: server.URL, name: "vm"}
+
+	packageDir := t.TempDir()
+	left := &VMRecord{Name: "vm", PackageDir: packageDir}
+	if err := os.WriteFile(filepath.Join(packageDir, cpuTemplateFile), []byte("T2CL\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fresh := &VMRecord{Name: "vm", PackageDir: filepath.Join(t.TempDir(), "missing")}
+
+	tests := []struct {
+		name      string
+		rec       *VMRecord
+		requested string
+		want      string
+	}{
+		{"requested", left, "C3", "C3"},
+		{"package left on this host", left, "", "T2CL"},
+		{"source", fresh, "", "T2S"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := migrationCPUTemplate(tt.rec, tt.requested, source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("migrationCPUTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	unreachable := &migrationSource{api: "http://127.0.0.1:1", name: "vm"}
+	if _, err := migrationCPUTemplate(fresh, "", unreachable); err == nil {
+		t.Error("migrationCPUTemplate() succeeded without any source of a template")
+	}
+}
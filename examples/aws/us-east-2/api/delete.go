@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What to do with a VM's log directory when it is deleted
+const (
+	LogsKeep    = "keep"
+	LogsArchive = "archive"
+	LogsDelete  = "delete"
+)
+
+var deletePhases = []string{"stop", "cleanup", "release"}
+
+// vmActive reports whether a VM is running or has a live tracked process
+func vmActive(rec *VMRecord) bool {
+	switch rec.Phase {
+	case PhaseStarting, PhaseRunning, PhaseMigratingOut, PhaseMigratingIn:
+		return true
+	}
+	for _, pid := range rec.PIDs {
+		if processAlive(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *DrafterAPI) deleteVM(c *gin.Context) {
+	name := c.Param("name")
+	log.Printf("Deleting VM: %s", name)
+
+	record, ok := api.lookupVM(c, name)
+	if !ok {
+		return
+	}
+
+	purge := false
+	if value := c.Query("purge"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid purge value %q", value)})
+			return
+		}
+		purge = parsed
+	}
+	// A deleted VM has nothing left to clean up but its record
+	if purge && record.Phase == PhaseDeleted {
+		api.purgeVM(c, name)
+		return
+	}
+	if !checkTransition(c, record, PhaseDeleted) {
+		return
+	}
+
+	force := false
+	if value := c.Query("force"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid force value %q", value)})
+			return
+		}
+		force = parsed
+	}
+	if !api.checkNoClones(c, name) {
+		return
+	}
+	if vmActive(record) && !force {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s is %s, pass force=true to delete it anyway", name, record.Phase)})
+		return
+	}
+
+	logs := c.DefaultQuery("logs", LogsKeep)
+	if logs != LogsKeep && logs != LogsArchive && logs != LogsDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid logs value %q, must be one of keep, archive, delete", logs)})
+		return
+	}
+
+	grace, err := api.stopGracePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	api.submitJob(c, "delete", name, deletePhases, func(run *JobRun) (gin.H, error) {
+		return api.runDelete(run, name, grace, logs, purge)
+	})
+}
+
+// purgeVM removes the record of a VM that is already deleted
+func (api *DrafterAPI) purgeVM(c *gin.Context, name string) {
+	if !api.checkNotBusy(c, name) {
+		return
+	}
+	if err := api.registry.Purge(name); err != nil {
+		switch {
+		case errors.Is(err, ErrVMNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("VM %s not found", name)})
+		case errors.Is(err, ErrVMNotDeleted):
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s is no longer deleted", name)})
+		default:
+			log.Printf("Error purging VM %s: %v", name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to purge VM record: %v", err)})
+		}
+		return
+	}
+
+	log.Printf("VM purged: %s", name)
+	c.JSON(http.StatusOK, gin.H{"message": "VM purged", "name": name})
+}
+
+func (api *DrafterAPI) runDelete(run *JobRun, name string, grace time.Duration, logs string, purge bool) (gin.H, error) {
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	run.Phase("stop")
+	results, err := api.stopVMProcesses(record, grace)
+	if err != nil {
+		log.Printf("Error stopping VM %s: %v", name, err)
+		api.failVM(name, err)
+		return gin.H{"name": name, "components": results}, err
+	}
+	for _, component := range stopOrder {
+		api.supervisor.Forget(name, component)
+	}
+
+	run.Phase("cleanup")
+	if record.BaseDir != "" {
+		log.Printf("Removing VM directory %s", record.BaseDir)
+		if err := os.RemoveAll(record.BaseDir); err != nil {
+			api.failVM(name, err)
+			return nil, fmt.Errorf("failed to remove VM directory %s: %v", record.BaseDir, err)
+		}
+	}
+
+	logsDir := filepath.Join(api.config.LogRoot, name)
+	logsResult, err := cleanupLogs(logsDir, logs)
+	if err != nil {
+		api.failVM(name, err)
+		return nil, err
+	}
+
+	run.Phase("release")
+	if err := api.netns.Release(name); err != nil {
+		log.Printf("Error releasing netns: %v", err)
+	}
+	if err := api.ports.Release(name); err != nil {
+		log.Printf("Error releasing ports: %v", err)
+	}
+	// The record stays behind in the deleted phase to keep its history,
+	// unless it is purged
+	if _, err := api.registry.Transition(name, PhaseDeleted, nil, func(rec *VMRecord) error {
+		rec.PIDs = nil
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
+	}
+	if purge {
+		if err := api.registry.Purge(name); err != nil {
+			return nil, fmt.Errorf("failed to purge VM record: %v", err)
+		}
+	}
+
+	log.Printf("VM deleted successfully: %s", name)
+	return gin.H{
+		"message":    "VM deleted",
+		"name":       name,
+		"components": results,
+		"logs":       logsResult,
+		"purged":     purge,
+	}, nil
+}
+
+// cleanupLogs keeps, archives or removes a VM's log directory and returns
+// where the logs ended up
+func cleanupLogs(logsDir, mode string) (string, error) {
+	if _, err := os.Stat(logsDir); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+
+	switch mode {
+	case LogsArchive:
+		archivePath := fmt.Sprintf("%s-%s.tar.gz", logsDir, time.Now().Format("2006-01-02_15-04-05"))
+		log.Printf("Archiving logs %s to %s", logsDir, archivePath)
+		if err := archiveDir(logsDir, archivePath); err != nil {
+			os.Remove(archivePath)
+			return "", fmt.Errorf("failed to archive logs: %v", err)
+		}
+		if err := os.RemoveAll(logsDir); err != nil {
+			return "", fmt.Errorf("failed to remove archived logs: %v", err)
+		}
+		return archivePath, nil
+	case LogsDelete:
+		log.Printf("Removing logs %s", logsDir)
+		if err := os.RemoveAll(logsDir); err != nil {
+			return "", fmt.Errorf("failed to remove logs: %v", err)
+		}
+		return "", nil
+	default:
+		return logsDir, nil
+	}
+}
+
+// archiveDir writes dir as a gzipped tarball rooted at the directory's name
+func archiveDir(dir, archivePath string) error {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	parent := filepath.Dir(dir)
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
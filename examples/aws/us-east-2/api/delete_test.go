@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPurgeDeletedVM(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	for name, phase := range map[string]string{"gone": PhaseDeleted, "live": PhaseReady} {
+		if err := reg.Put(&VMRecord{Name: name, Phase: phase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg, jobs: NewJobManager(reg, 0)}
+	router.DELETE("/vm/:name", api.deleteVM)
+	deleteVM := func(path string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		return w.Code
+	}
+
+	if code := deleteVM("/vm/gone?purge=maybe"); code != http.StatusBadRequest {
+		t.Errorf("invalid purge returned %d, want %d", code, http.StatusBadRequest)
+	}
+	// Without purge a deleted VM cannot be deleted again
+	if code := deleteVM("/vm/gone"); code != http.StatusConflict {
+		t.Errorf("deleting a deleted VM returned %d, want %d", code, http.StatusConflict)
+	}
+	if code := deleteVM("/vm/gone?purge=true"); code != http.StatusOK {
+		t.Fatalf("purging a deleted VM returned %d, want %d", code, http.StatusOK)
+	}
+	if _, err := reg.Get("gone"); !errors.Is(err, ErrVMNotFound) {
+		t.Errorf("Get(gone) = %v after purge, want ErrVMNotFound", err)
+	}
+	if code := deleteVM("/vm/gone?purge=true"); code != http.StatusNotFound {
+		t.Errorf("purging a purged VM returned %d, want %d", code, http.StatusNotFound)
+	}
+
+	if err := reg.Purge("live"); !errors.Is(err, ErrVMNotDeleted) {
+		t.Errorf("Purge(live) = %v, want ErrVMNotDeleted", err)
+	}
+	if _, err := reg.Get("live"); err != nil {
+		t.Errorf("Get(live) = %v, the record should be kept", err)
+	}
+}
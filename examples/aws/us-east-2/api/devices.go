@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DeviceTuning controls how drafter-peer serves a device and how it moves
+// the device's dirty blocks during a migration
+type DeviceTuning struct {
+	BlockSize      uint32        `json:"blockSize"`
+	Expiry         time.Duration `json:"expiry"`
+	MaxDirtyBlocks int           `json:"maxDirtyBlocks"`
+	MinCycles      int           `json:"minCycles"`
+	MaxCycles      int           `json:"maxCycles"`
+	CycleThrottle  time.Duration `json:"cycleThrottle"`
+}
+
+const (
+	minBlockSize = 4 << 10
+	maxBlockSize = 16 << 20
+)
+
+// defaultDeviceTuning is the default tuning profile
+var defaultDeviceTuning = DeviceTuning{
+	BlockSize:      64 << 10,
+	Expiry:         time.Second,
+	MaxDirtyBlocks: 200,
+	MinCycles:      5,
+	MaxCycles:      20,
+	CycleThrottle:  500 * time.Millisecond,
+}
+
+func (t DeviceTuning) validate() error {
+	var problems []string
+	if t.BlockSize < minBlockSize || t.BlockSize > maxBlockSize || t.BlockSize&(t.BlockSize-1) != 0 {
+		problems = append(problems, fmt.Sprintf("blockSize must be a power of two between %d and %d, got %d", minBlockSize, maxBlockSize, t.BlockSize))
+	}
+	if t.Expiry <= 0 {
+		problems = append(problems, fmt.Sprintf("expiry must be positive, got %s", t.Expiry))
+	}
+	if t.MaxDirtyBlocks < 1 {
+		problems = append(problems, fmt.Sprintf("maxDirtyBlocks must be at least 1, got %d", t.MaxDirtyBlocks))
+	}
+	if t.MinCycles < 1 {
+		problems = append(problems, fmt.Sprintf("minCycles must be at least 1, got %d", t.MinCycles))
+	}
+	if t.MaxCycles < t.MinCycles {
+		problems = append(problems, fmt.Sprintf("maxCycles must be at least minCycles (%d), got %d", t.MinCycles, t.MaxCycles))
+	}
+	if t.CycleThrottle < 0 {
+		problems = append(problems, fmt.Sprintf("cycleThrottle must not be negative, got %s", t.CycleThrottle))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// PeerDevice is one entry of drafter-peer's --devices
+type PeerDevice struct {
+	Name    string `json:"name"`
+	Base    string `json:"base"`
+	Overlay string `json:"overlay"`
+	State   string `json:"state"`
+
+	DeviceTuning
+
+	MakeMigratable bool `json:"makeMigratable"`
+	Shared         bool `json:"shared"`
+}
+
+func (d PeerDevice) validate() error {
+	if err := checkPaths(d.Base, d.Overlay, d.State); err != nil {
+		return err
+	}
+	return d.DeviceTuning.validate()
+}
+
+// SnapshotterDevice is one entry of drafter-snapshotter's --devices. Only
+// the devices the VM boots from have an input.
+type SnapshotterDevice struct {
+	Name   string `json:"name"`
+	Input  string `json:"input,omitempty"`
+	Output string `json:"output"`
+}
+
+func (d SnapshotterDevice) validate() error {
+	if d.Input != "" {
+		if err := checkPaths(d.Input); err != nil {
+			return err
+		}
+	}
+	return checkPaths(d.Output)
+}
+
+// PackagerDevice is one entry of drafter-packager's --devices
+type PackagerDevice struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func (d PackagerDevice) validate() error {
+	return checkPaths(d.Path)
+}
+
+// portForward is one entry of drafter-forwarder's --port-forwards
+type portForward struct {
+	Netns        string `json:"netns"`
+	InternalPort string `json:"internalPort"`
+	Protocol     string `json:"protocol"`
+	ExternalAddr string `json:"externalAddr"`
+}
+
+func checkPaths(paths ...string) error {
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("path %q is not absolute", path)
+		}
+	}
+	return nil
+}
+
+type deviceConfig interface {
+	validate() error
+}
+
+// encodeDevices validates a --devices list and marshals it. Device names
+// must be set and unique.
+func encodeDevices[T deviceConfig](devices []T, name func(T) string) (string, error) {
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		n := name(device)
+		if n == "" {
+			return "", errors.New("device has no name")
+		}
+		if seen[n] {
+			return "", fmt.Errorf("device %s is listed twice", n)
+		}
+		seen[n] = true
+		if err := device.validate(); err != nil {
+			return "", fmt.Errorf("device %s: %v", n, err)
+		}
+	}
+
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode devices: %v", err)
+	}
+	return string(data), nil
+}
+
+// snapshotterDevicesJSON snapshots the devices in blueprintDir into packageDir
+func snapshotterDevicesJSON(blueprintDir, packageDir string) (string, error) {
+	devices := make([]SnapshotterDevice, 0, len(packageFiles))
+	for _, f := range packageFiles {
+		device := SnapshotterDevice{Name: f.Device, Output: filepath.Join(packageDir, f.File)}
+		if f.Input {
+			device.Input = filepath.Join(blueprintDir, f.File)
+		}
+		devices = append(devices, device)
+	}
+	return encodeDevices(devices, func(d SnapshotterDevice) string { return d.Name })
+}
+
+// peerDevicesJSON serves the VM's package as the base of every device, with
+// writes going to the VM's own overlay and state, tuned as the VM asks
+func peerDevicesJSON(rec *VMRecord) (string, error) {
+	devices := make([]PeerDevice, 0, len(packageFiles))
+	for _, f := range packageFiles {
+		tuning, err := rec.Config.Tuning.Device(f.Device)
+		if err != nil {
+			return "", err
+		}
+		devices = append(devices, PeerDevice{
+			Name:           f.Device,
+			Base:           filepath.Join(rec.PackageDir, f.File),
+			Overlay:        filepath.Join(rec.OverlayDir, f.File),
+			State:          filepath.Join(rec.StateDir, f.File),
+			DeviceTuning:   tuning,
+			MakeMigratable: true,
+		})
+	}
+	return encodeDevices(devices, func(d PeerDevice) string { return d.Name })
+}
+
+// packagerDevicesJSON extracts the named devices of a package into dir
+func packagerDevicesJSON(dir string, names ...string) (string, error) {
+	devices := make([]PackagerDevice, 0, len(names))
+	for _, name := range names {
+		for _, f := range packageFiles {
+			if f.Device == name {
+				devices = append(devices, PackagerDevice{Name: name, Path: filepath.Join(dir, f.File)})
+			}
+		}
+	}
+	if len(devices) != len(names) {
+		return "", fmt.Errorf("unknown device in %v", names)
+	}
+	return encodeDevices(devices, func(d PackagerDevice) string { return d.Name })
+}
+
+// portForwardsJSON forwards addr on the host to port inside netns
+func portForwardsJSON(netns, port, addr string) (string, error) {
+	data, err := json.Marshal([]portForward{{Netns: netns, InternalPort: port, Protocol: "tcp", ExternalAddr: addr}})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode port forwards: %v", err)
+	}
+	return string(data), nil
+}
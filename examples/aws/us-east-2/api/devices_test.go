@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPeerDevicesJSON(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DataRoot = "/srv/drafter"
+	rec := &VMRecord{Name: "vm-1"}
+	cfg.setVMPaths(rec)
+
+	devices, err := peerDevicesJSON(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []map[string]interface{}
+	if err := json.Unmarshal([]byte(devices), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(packageFiles) {
+		t.Fatalf("got %d devices, want %d", len(parsed), len(packageFiles))
+	}
+	state := parsed[0]
+	for key, want := range map[string]interface{}{
+		"name":           "state",
+		"base":           "/srv/drafter/vm-1/package/state.bin",
+		"overlay":        "/srv/drafter/vm-1/instance/overlay/state.bin",
+		"state":          "/srv/drafter/vm-1/instance/state/state.bin",
+		"makeMigratable": true,
+		"shared":         false,
+	} {
+		if state[key] != want {
+			t.Errorf("state device %s = %v, want %v", key, state[key], want)
+		}
+	}
+}
+
+func TestSnapshotterDevicesJSON(t *testing.T) {
+	devices, err := snapshotterDevicesJSON("/srv/drafter/vm-1/blueprint", "/srv/drafter/vm-1/package")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []SnapshotterDevice
+	if err := json.Unmarshal([]byte(devices), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range parsed {
+		// Only the devices the VM boots from are read from the blueprint
+		input := device.Name == "kernel" || device.Name == "disk" || device.Name == "oci"
+		if (device.Input != "") != input {
+			t.Errorf("device %s has input %q", device.Name, device.Input)
+		}
+		if !strings.HasPrefix(device.Output, "/srv/drafter/vm-1/package/") {
+			t.Errorf("device %s is written to %q, want the package", device.Name, device.Output)
+		}
+	}
+	if strings.Contains(devices, `"input":""`) {
+		t.Errorf("devices %s list empty inputs", devices)
+	}
+}
+
+func TestEncodeDevices(t *testing.T) {
+	name := func(d PackagerDevice) string { return d.Name }
+	tests := []struct {
+		name    string
+		devices []PackagerDevice
+		wantErr string
+	}{
+		{"valid", []PackagerDevice{{Name: "kernel", Path: "/srv/vmlinux"}, {Name: "disk", Path: "/srv/rootfs.ext4"}}, ""},
+		{"no name", []PackagerDevice{{Path: "/srv/vmlinux"}}, "device has no name"},
+		{"listed twice", []PackagerDevice{{Name: "disk", Path: "/srv/a"}, {Name: "disk", Path: "/srv/b"}}, "device disk is listed twice"},
+		{"relative path", []PackagerDevice{{Name: "disk", Path: "rootfs.ext4"}}, `device disk: path "rootfs.ext4" is not absolute`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := encodeDevices(tt.devices, name)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("encodeDevices() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("encodeDevices() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := packagerDevicesJSON("/srv/out", "kernel", "swap"); err == nil {
+		t.Error("packagerDevicesJSON() accepted an unknown device")
+	}
+}
+
+func TestPortForwardsJSON(t *testing.T) {
+	forwards, err := portForwardsJSON("ark3", "6379", "127.0.0.1:3336")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"netns":"ark3","internalPort":"6379","protocol":"tcp","externalAddr":"127.0.0.1:3336"}]`; forwards != want {
+		t.Errorf("portForwardsJSON() = %s, want %s", forwards, want)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const procNetRoute = "/proc/net/route"
+
+// rtfUp is the RTF_UP route flag
+const rtfUp = 0x1
+
+// defaultRouteInterface finds the interface of the default route in a
+// /proc/net/route table, preferring the lowest metric when there are several
+func defaultRouteInterface(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read routing table: %v", err)
+	}
+	defer f.Close()
+
+	best, bestMetric := "", -1
+	scanner := bufio.NewScanner(f)
+	// The first line names the columns
+	scanner.Scan()
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfUp == 0 {
+			continue
+		}
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[0], metric
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read routing table: %v", err)
+	}
+	if best == "" {
+		return "", errors.New("no default route in the routing table")
+	}
+	return best, nil
+}
+
+// resolveHostInterface uses the default route's interface when none is
+// configured
+func (cfg *Config) resolveHostInterface() error {
+	if cfg.HostInterface != "" {
+		return nil
+	}
+	iface, err := defaultRouteInterface(procNetRoute)
+	if err != nil {
+		return fmt.Errorf("cannot detect the host interface, set -host-interface: %v", err)
+	}
+	cfg.HostInterface = iface
+	cfg.hostInterfaceDetected = true
+	return nil
+}
+
+// interfaceAddrs lists the IP addresses of a network interface
+func interfaceAddrs(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// getHostInfo reports what the API runs with on this host: the interface
+// drafter-nat uses, the CPU and the drafter release
+func (api *DrafterAPI) getHostInfo(c *gin.Context) {
+	source := "config"
+	if api.config.hostInterfaceDetected {
+		source = "default-route"
+	}
+	network := gin.H{
+		"host_interface": api.config.HostInterface,
+		"source":         source,
+	}
+	if addrs, err := interfaceAddrs(api.config.HostInterface); err != nil {
+		network["error"] = err.Error()
+	} else {
+		network["addresses"] = addrs
+	}
+	// The route may have moved since startup, which a configured interface
+	// would not follow
+	if iface, err := defaultRouteInterface(procNetRoute); err != nil {
+		network["default_route_error"] = err.Error()
+	} else {
+		network["default_route_interface"] = iface
+	}
+
+	cpu := gin.H{"info": hostCPU(), "count": runtime.NumCPU()}
+	if template, err := resolveCPUTemplate(""); err == nil {
+		cpu["default_template"] = template
+	}
+
+	hostname, _ := os.Hostname()
+	c.JSON(http.StatusOK, gin.H{
+		"hostname":        hostname,
+		"network":         network,
+		"cpu":             cpu,
+		"drafter_version": api.config.Artifacts.Version,
+		"data_root":       api.config.DataRoot,
+		"log_root":        api.config.LogRoot,
+	})
+}
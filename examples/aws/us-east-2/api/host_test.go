@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const routeHeader = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+func writeRouteTable(t *testing.T, routes string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "route")
+	if err := os.WriteFile(path, []byte(routeHeader+routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultRouteInterface(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes string
+		want   string
+	}{
+		{
+			"single default route",
+			"eth0\t00000000\t0100000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"eth0\t0000000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			"eth0",
+		},
+		{
+			"lowest metric wins",
+			"wlan0\t00000000\t0101A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+				"ens5\t00000000\t0100000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+				"tun0\t00000000\t00000000\t0003\t0\t0\t300\t00000000\t0\t0\t0\n",
+			"ens5",
+		},
+		{
+			"routes that are down are skipped",
+			"eth1\t00000000\t0100000A\t0002\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\t0100000A\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			"eth0",
+		},
+		{
+			"masked routes are not default routes",
+			"eth1\t00000000\t0100000A\t0003\t0\t0\t0\t000000FF\t0\t0\t0\n" +
+				"eth0\t00000000\t0100000A\t0003\t0\t0\t50\t00000000\t0\t0\t0\n",
+			"eth0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := defaultRouteInterface(writeRouteTable(t, tt.routes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("defaultRouteInterface() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRouteInterfaceMissing(t *testing.T) {
+	path := writeRouteTable(t, "eth0\t0000000A\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n")
+	if iface, err := defaultRouteInterface(path); err == nil {
+		t.Errorf("defaultRouteInterface() = %s, want an error without a default route", iface)
+	}
+	if _, err := defaultRouteInterface(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing routing table")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// Keys are forgotten after this long and may then be reused
+	idempotencyKeyTTL    = 24 * time.Hour
+	maxIdempotencyKeyLen = 255
+)
+
+var idempotencyBucket = []byte("idempotency")
+
+// idempotencyEntry remembers which job a keyed request started
+type idempotencyEntry struct {
+	Key       string    `json:"key"`
+	VM        string    `json:"vm"`
+	Request   string    `json:"request"`
+	JobID     string    `json:"job_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (e *idempotencyEntry) expired() bool {
+	return time.Since(e.CreatedAt) > idempotencyKeyTTL
+}
+
+// requestFingerprint identifies a request by its method, path, query and
+// body, so a reused key can be told apart from a retry
+func requestFingerprint(c *gin.Context, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ClaimIdempotencyKey stores entry unless its key is already in use, in which
+// case it returns the existing entry and false
+func (r *Registry) ClaimIdempotencyKey(entry *idempotencyEntry) (*idempotencyEntry, bool, error) {
+	var existing *idempotencyEntry
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		if data := b.Get([]byte(entry.Key)); data != nil {
+			var stored idempotencyEntry
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return fmt.Errorf("failed to decode idempotency key %s: %v", entry.Key, err)
+			}
+			if !stored.expired() {
+				existing = &stored
+				return nil
+			}
+		}
+
+		entry.CreatedAt = time.Now().UTC()
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(entry.Key), data)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return existing, existing == nil, nil
+}
+
+// SetIdempotencyJob records the job a claimed key started
+func (r *Registry) SetIdempotencyJob(key, jobID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		data := b.Get([]byte(key))
+		if data == nil {
+			return fmt.Errorf("idempotency key %s not found", key)
+		}
+		var entry idempotencyEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("failed to decode idempotency key %s: %v", key, err)
+		}
+		entry.JobID = jobID
+		data, err := json.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// ReleaseIdempotencyKey forgets a key whose request did not start a job
+func (r *Registry) ReleaseIdempotencyKey(key string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(idempotencyBucket).Delete([]byte(key))
+	})
+}
+
+// pruneIdempotencyKeys forgets expired keys, which are otherwise only
+// replaced when the same key is used again. It runs at startup, so a key
+// without a job belongs to a request the API went down in the middle of;
+// it is released too rather than answering 409 until it expires.
+func pruneIdempotencyKeys(tx *bolt.Tx) error {
+	b := tx.Bucket(idempotencyBucket)
+	var expired [][]byte
+	if err := b.ForEach(func(k, v []byte) error {
+		var entry idempotencyEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("failed to decode idempotency key %s: %v", k, err)
+		}
+		if entry.expired() {
+			expired = append(expired, k)
+		} else if entry.JobID == "" {
+			log.Printf("Releasing idempotency key %s of VM %s, its request was interrupted", k, entry.VM)
+			expired = append(expired, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Removed %d expired idempotency keys", len(expired))
+	}
+	return nil
+}
+
+// replayIdempotent answers a request whose Idempotency-Key was seen before
+// with the job the first request started
+func (api *DrafterAPI) replayIdempotent(c *gin.Context, entry *idempotencyEntry, fingerprint string) {
+	if entry.Request != fingerprint {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("%s %q was already used for a different request", idempotencyHeader, entry.Key)})
+		return
+	}
+	if entry.JobID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("a request with %s %q is still being processed", idempotencyHeader, entry.Key)})
+		return
+	}
+
+	job, err := api.jobs.Get(entry.JobID)
+	if err != nil {
+		log.Printf("Error reading job %s: %v", entry.JobID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read job: %v", err)})
+		return
+	}
+
+	log.Printf("Replaying %s %s for VM %s: job %s", idempotencyHeader, entry.Key, entry.VM, job.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"message":    fmt.Sprintf("VM %s already queued", job.Type),
+		"name":       entry.VM,
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+		"job":        job,
+	})
+}
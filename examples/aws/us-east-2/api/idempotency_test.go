@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateVMIdempotency(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	// Without workers the create jobs stay queued
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg, jobs: NewJobManager(reg, 0)}
+	router.POST("/vm/create", api.createVM)
+	create := func(key, body string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/vm/create", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(idempotencyHeader, key)
+		}
+		router.ServeHTTP(w, req)
+		var resp struct {
+			JobID string `json:"job_id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.JobID
+	}
+
+	code, jobID := create("create-web", `{"name": "web"}`)
+	if code != http.StatusAccepted || jobID == "" {
+		t.Fatalf("create returned %d with job %q, want %d", code, jobID, http.StatusAccepted)
+	}
+	// A retry gets the job of the first request back
+	if code, replayed := create("create-web", `{"name": "web"}`); code != http.StatusOK || replayed != jobID {
+		t.Errorf("retry returned %d with job %q, want %d with %q", code, replayed, http.StatusOK, jobID)
+	}
+	if code, _ := create("create-web", `{"name": "db"}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing a key for another request returned %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+	if code, _ := create(strings.Repeat("k", maxIdempotencyKeyLen+1), `{"name": "db"}`); code != http.StatusBadRequest {
+		t.Errorf("an overlong key returned %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Without a key the name is simply taken
+	if code, _ := create("", `{"name": "web"}`); code != http.StatusConflict {
+		t.Errorf("creating web again returned %d, want %d", code, http.StatusConflict)
+	}
+	// A key whose request was refused is released, so it can be used again
+	if code, _ := create("create-web-again", `{"name": "web"}`); code != http.StatusConflict {
+		t.Errorf("creating web again returned %d, want %d", code, http.StatusConflict)
+	}
+	if _, claimed, err := reg.ClaimIdempotencyKey(&idempotencyEntry{Key: "create-web-again", VM: "web"}); err != nil || !claimed {
+		t.Errorf("ClaimIdempotencyKey() of a refused request's key = %v, %v, want it free", claimed, err)
+	}
+}
@@ -12,6 +12,9 @@ mkdir -p "$INSTALL_DIR"
 # Get system architecture
 ARCH=$(uname -m)
 
+# The API downloads its artifacts from this release too (-drafter-version)
+DRAFTER_VERSION="${DRAFTER_VERSION:-v0.5.0}"
+
 # Install Drafter binaries
 DRAFTER_BINARIES=(
     "drafter-nat"
@@ -26,13 +29,16 @@ DRAFTER_BINARIES=(
 )
 
 for BINARY in "${DRAFTER_BINARIES[@]}"; do
-    echo "Downloading $BINARY..."
-    wget -q -O "$INSTALL_DIR/$BINARY" "https://github.com/loopholelabs/drafter/releases/latest/download/$BINARY.linux-$ARCH"
+    echo "Downloading $BINARY $DRAFTER_VERSION..."
+    wget -q -O "$INSTALL_DIR/$BINARY" "https://github.com/loopholelabs/drafter/releases/download/$DRAFTER_VERSION/$BINARY.linux-$ARCH"
     chmod +x "$INSTALL_DIR/$BINARY"
     echo "Installing $BINARY..."
     sudo install -v "$INSTALL_DIR/$BINARY" /usr/local/bin
 done
 
+# The API checks that the binaries match its artifacts against this file
+echo "$DRAFTER_VERSION" | sudo tee /usr/local/bin/drafter.version > /dev/null
+
 # Install Firecracker with PVM support
 FIRECRACKER_BINARIES=(
     "firecracker"
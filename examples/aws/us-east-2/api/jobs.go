@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobSkipped   JobStatus = "skipped"
+)
+
+const (
+	jobQueueSize = 100
+	// Progress updates are persisted at most this often
+	jobProgressFlushInterval = 2 * time.Second
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobQueueFull = errors.New("job queue is full")
+	ErrVMBusy       = errors.New("vm has a job in progress")
+)
+
+var jobsBucket = []byte("jobs")
+
+// JobPhase is one step of a job, such as download or snapshot
+type JobPhase struct {
+	Name       string     `json:"name"`
+	Status     JobStatus  `json:"status"`
+	Progress   float64    `json:"progress"`
+	Message    string     `json:"message,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Job is a long-running VM operation executed by the worker pool
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	VM         string      `json:"vm"`
+	Status     JobStatus   `json:"status"`
+	Phases     []*JobPhase `json:"phases"`
+	Error      string      `json:"error,omitempty"`
+	Result     gin.H       `json:"result,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+func (j *Job) clone() *Job {
+	copied := *j
+	copied.Phases = make([]*JobPhase, len(j.Phases))
+	for i, phase := range j.Phases {
+		p := *phase
+		copied.Phases[i] = &p
+	}
+	return &copied
+}
+
+// JobFunc does the work of a job and returns its result
+type JobFunc func(run *JobRun) (gin.H, error)
+
+type jobTask struct {
+	job *Job
+	fn  JobFunc
+}
+
+// JobManager queues jobs, runs them on a pool of workers and persists their
+// state in the registry database
+type JobManager struct {
+	registry *Registry
+	queue    chan *jobTask
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// active maps a VM name to the ID of its unfinished job
+	active map[string]string
+}
+
+func NewJobManager(registry *Registry, workers int) *JobManager {
+	m := &JobManager{
+		registry: registry,
+		queue:    make(chan *jobTask, jobQueueSize),
+		jobs:     make(map[string]*Job),
+		active:   make(map[string]string),
+	}
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	return m
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Submit queues fn as a new job for vm. The phases are listed up front so
+// clients can see what is still to come.
+func (m *JobManager) Submit(jobType, vm string, phases []string, fn JobFunc) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        id,
+		Type:      jobType,
+		VM:        vm,
+		Status:    JobPending,
+		CreatedAt: now,
+	}
+	for _, name := range phases {
+		job.Phases = append(job.Phases, &JobPhase{Name: name, Status: JobPending})
+	}
+
+	// Claim the VM first so a second submit fails fast, then persist the job
+	// without holding the lock
+	m.mu.Lock()
+	if active, ok := m.active[vm]; ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrVMBusy, active)
+	}
+	m.jobs[job.ID] = job
+	m.active[vm] = job.ID
+	snapshot := job.clone()
+	m.mu.Unlock()
+
+	if err := m.registry.PutJob(snapshot); err != nil {
+		m.forget(job)
+		return nil, fmt.Errorf("failed to persist job: %v", err)
+	}
+
+	select {
+	case m.queue <- &jobTask{job: job, fn: fn}:
+	default:
+		m.forget(job)
+		job.Status = JobFailed
+		job.Error = ErrJobQueueFull.Error()
+		finished := time.Now().UTC()
+		job.FinishedAt = &finished
+		if err := m.registry.PutJob(job); err != nil {
+			log.Printf("Error persisting job %s: %v", job.ID, err)
+		}
+		return nil, ErrJobQueueFull
+	}
+
+	log.Printf("Queued %s job %s for VM %s", jobType, job.ID, vm)
+	return snapshot, nil
+}
+
+// forget drops a job that never made it onto the queue
+func (m *JobManager) forget(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.jobs, job.ID)
+	if m.active[job.VM] == job.ID {
+		delete(m.active, job.VM)
+	}
+}
+
+// Active returns the ID of the VM's unfinished job, if any
+func (m *JobManager) Active(vm string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.active[vm]
+	return id, ok
+}
+
+// Get returns a job, looking in the registry for jobs from earlier runs
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if ok {
+		snapshot := job.clone()
+		m.mu.Unlock()
+		return snapshot, nil
+	}
+	m.mu.Unlock()
+
+	return m.registry.GetJob(id)
+}
+
+func (m *JobManager) worker() {
+	for task := range m.queue {
+		m.run(task)
+	}
+}
+
+func (m *JobManager) run(task *jobTask) {
+	run := &JobRun{manager: m, job: task.job}
+
+	m.mu.Lock()
+	now := time.Now().UTC()
+	task.job.Status = JobRunning
+	task.job.StartedAt = &now
+	m.mu.Unlock()
+	m.persist(task.job)
+
+	log.Printf("Running %s job %s for VM %s", task.job.Type, task.job.ID, task.job.VM)
+	result, err := m.call(task.fn, run)
+
+	m.mu.Lock()
+	finished := time.Now().UTC()
+	task.job.FinishedAt = &finished
+	task.job.Result = result
+	for _, phase := range task.job.Phases {
+		switch {
+		case phase.Status == JobRunning && err != nil:
+			phase.Status = JobFailed
+			phase.Error = err.Error()
+			phase.FinishedAt = &finished
+		case phase.Status == JobRunning:
+			phase.Status = JobSucceeded
+			phase.Progress = 1
+			phase.FinishedAt = &finished
+		case phase.Status == JobPending:
+			phase.Status = JobSkipped
+		}
+	}
+	if err != nil {
+		task.job.Status = JobFailed
+		task.job.Error = err.Error()
+	} else {
+		task.job.Status = JobSucceeded
+	}
+	delete(m.active, task.job.VM)
+	m.mu.Unlock()
+	m.persist(task.job)
+
+	// Finished jobs are served from the registry from now on
+	m.mu.Lock()
+	delete(m.jobs, task.job.ID)
+	m.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Job %s for VM %s failed: %v", task.job.ID, task.job.VM, err)
+	} else {
+		log.Printf("Job %s for VM %s succeeded", task.job.ID, task.job.VM)
+	}
+}
+
+// call runs fn, turning a panic into a job failure
+func (m *JobManager) call(fn JobFunc, run *JobRun) (result gin.H, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return fn(run)
+}
+
+func (m *JobManager) persist(job *Job) {
+	m.mu.Lock()
+	snapshot := job.clone()
+	m.mu.Unlock()
+
+	if err := m.registry.PutJob(snapshot); err != nil {
+		log.Printf("Error persisting job %s: %v", job.ID, err)
+	}
+}
+
+// JobRun is handed to a JobFunc to report progress
+type JobRun struct {
+	manager   *JobManager
+	job       *Job
+	current   *JobPhase
+	lastFlush time.Time
+}
+
+// Phase marks the current phase as done and starts the named one
+func (r *JobRun) Phase(name string) {
+	r.manager.mu.Lock()
+	now := time.Now().UTC()
+	if r.current != nil && r.current.Status == JobRunning {
+		r.current.Status = JobSucceeded
+		r.current.Progress = 1
+		r.current.FinishedAt = &now
+	}
+
+	r.current = nil
+	for _, phase := range r.job.Phases {
+		if phase.Name == name {
+			r.current = phase
+			break
+		}
+	}
+	if r.current == nil {
+		r.current = &JobPhase{Name: name}
+		r.job.Phases = append(r.job.Phases, r.current)
+	}
+	r.current.Status = JobRunning
+	r.current.StartedAt = &now
+	r.manager.mu.Unlock()
+
+	log.Printf("Job %s: %s", r.job.ID, name)
+	r.manager.persist(r.job)
+	r.lastFlush = time.Now()
+}
+
+// Progress sets the completed fraction of the current phase
+func (r *JobRun) Progress(fraction float64, message string) {
+	r.manager.mu.Lock()
+	if r.current == nil {
+		r.manager.mu.Unlock()
+		return
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	r.current.Progress = fraction
+	r.current.Message = message
+	r.manager.mu.Unlock()
+
+	if time.Since(r.lastFlush) >= jobProgressFlushInterval {
+		r.manager.persist(r.job)
+		r.lastFlush = time.Now()
+	}
+}
+
+// PutJob stores a job in the registry database
+func (r *Registry) PutJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %v", job.ID, err)
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), data)
+	})
+}
+
+func (r *Registry) GetJob(id string) (*Job, error) {
+	var job Job
+	err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrJobNotFound
+		}
+		return json.Unmarshal(data, &job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FailInterruptedJobs marks jobs left unfinished by a previous run as failed
+// and drops jobs that finished more than retention ago, along with expired
+// idempotency keys and keys whose request never got as far as a job
+func (r *Registry) FailInterruptedJobs(retention time.Duration) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		now := time.Now().UTC()
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("failed to decode job %s: %v", k, err)
+			}
+			if job.Status != JobPending && job.Status != JobRunning {
+				if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > retention {
+					expired = append(expired, k)
+				}
+				return nil
+			}
+
+			job.Status = JobFailed
+			job.Error = "interrupted by API restart"
+			job.FinishedAt = &now
+			data, err := json.Marshal(&job)
+			if err != nil {
+				return err
+			}
+			log.Printf("Marked interrupted job %s for VM %s as failed", job.ID, job.VM)
+			return b.Put(k, data)
+		}); err != nil {
+			return err
+		}
+
+		// Keys cannot be deleted while iterating over the bucket
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		if len(expired) > 0 {
+			log.Printf("Removed %d jobs that finished more than %s ago", len(expired), retention)
+		}
+		return pruneIdempotencyKeys(tx)
+	})
+}
+
+func (api *DrafterAPI) getJob(c *gin.Context) {
+	job, err := api.jobs.Get(c.Param("id"))
+	if errors.Is(err, ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("job %s not found", c.Param("id"))})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading job %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read job: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// submitJob queues a job for a VM and writes the 202 response
+func (api *DrafterAPI) submitJob(c *gin.Context, jobType, vm string, phases []string, fn JobFunc) (*Job, bool) {
+	job, err := api.jobs.Submit(jobType, vm, phases, fn)
+	if errors.Is(err, ErrVMBusy) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "name": vm})
+		return nil, false
+	}
+	if errors.Is(err, ErrJobQueueFull) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error submitting %s job for VM %s: %v", jobType, vm, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to submit job: %v", err)})
+		return nil, false
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    fmt.Sprintf("VM %s queued", jobType),
+		"name":       vm,
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+	})
+	return job, true
+}
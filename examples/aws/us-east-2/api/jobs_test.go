@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestJobManagerSubmit(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	// Without workers nothing leaves the queue
+	m := NewJobManager(reg, 0)
+	noop := func(run *JobRun) (gin.H, error) { return nil, nil }
+
+	job, err := m.Submit("create", "vm-0", []string{"download", "snapshot"}, noop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := reg.GetJob(job.ID)
+	if err != nil {
+		t.Fatalf("GetJob(%s) = %v, the job was not persisted", job.ID, err)
+	}
+	if stored.Status != JobPending || len(stored.Phases) != 2 {
+		t.Errorf("stored job is %s with %d phases, want pending with 2", stored.Status, len(stored.Phases))
+	}
+	if id, ok := m.Active("vm-0"); !ok || id != job.ID {
+		t.Errorf("Active(vm-0) = %q, %v, want %q", id, ok, job.ID)
+	}
+
+	if _, err := m.Submit("start", "vm-0", nil, noop); !errors.Is(err, ErrVMBusy) {
+		t.Errorf("second job for vm-0 returned %v, want ErrVMBusy", err)
+	}
+
+	for i := 1; i < jobQueueSize; i++ {
+		if _, err := m.Submit("create", fmt.Sprintf("vm-%d", i), nil, noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Submit("create", "overflow", nil, noop); !errors.Is(err, ErrJobQueueFull) {
+		t.Fatalf("submit to a full queue returned %v, want ErrJobQueueFull", err)
+	}
+	// A job that could not be queued does not keep its VM busy
+	if id, ok := m.Active("overflow"); ok {
+		t.Errorf("Active(overflow) = %q, want no job", id)
+	}
+}
+
+func TestJobManagerRun(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	m := NewJobManager(reg, 1)
+	wait := func(id string) *Job {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			job, err := m.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.Status == JobSucceeded || job.Status == JobFailed {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s did not finish", id)
+		return nil
+	}
+
+	job, err := m.Submit("create", "vm", []string{"download", "snapshot", "verify"}, func(run *JobRun) (gin.H, error) {
+		run.Phase("download")
+		run.Phase("snapshot")
+		return nil, errors.New("snapshotter exited")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = wait(job.ID)
+	if job.Status != JobFailed || job.Error != "snapshotter exited" {
+		t.Errorf("job is %s with error %q, want failed with the cause", job.Status, job.Error)
+	}
+	for i, want := range []JobStatus{JobSucceeded, JobFailed, JobSkipped} {
+		if got := job.Phases[i].Status; got != want {
+			t.Errorf("phase %s is %s, want %s", job.Phases[i].Name, got, want)
+		}
+	}
+	if _, ok := m.Active("vm"); ok {
+		t.Error("a finished job keeps its VM busy")
+	}
+
+	// A panicking job fails instead of taking the worker down
+	job, err = m.Submit("start", "vm", nil, func(run *JobRun) (gin.H, error) {
+		panic("boom")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = wait(job.ID); job.Status != JobFailed {
+		t.Errorf("panicking job is %s, want failed", job.Status)
+	}
+}
+
+func TestFailInterruptedJobs(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	now := time.Now().UTC()
+	old := now.Add(-8 * 24 * time.Hour)
+	recent := now.Add(-time.Hour)
+	for _, job := range []*Job{
+		{ID: "running", Status: JobRunning, CreatedAt: old},
+		{ID: "pending", Status: JobPending, CreatedAt: old},
+		{ID: "old", Status: JobSucceeded, CreatedAt: old, FinishedAt: &old},
+		{ID: "recent", Status: JobFailed, CreatedAt: recent, FinishedAt: &recent},
+	} {
+		if err := reg.PutJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Claiming a key stamps it with the current time, so the expired one is
+	// written directly
+	for _, key := range []string{"fresh", "interrupted"} {
+		if _, _, err := reg.ClaimIdempotencyKey(&idempotencyEntry{Key: key, VM: "vm"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.SetIdempotencyJob("fresh", "recent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(&idempotencyEntry{Key: "stale", VM: "vm", CreatedAt: now.Add(-2 * idempotencyKeyTTL)})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(idempotencyBucket).Put([]byte("stale"), data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.FailInterruptedJobs(7 * 24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]JobStatus{"running": JobFailed, "pending": JobFailed, "recent": JobFailed} {
+		job, err := reg.GetJob(id)
+		if err != nil {
+			t.Errorf("GetJob(%s) = %v", id, err)
+			continue
+		}
+		if job.Status != want {
+			t.Errorf("job %s is %s, want %s", id, job.Status, want)
+		}
+	}
+	if _, err := reg.GetJob("old"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("GetJob(old) = %v, want ErrJobNotFound", err)
+	}
+
+	if err := reg.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		if b.Get([]byte("fresh")) == nil {
+			t.Error("the fresh idempotency key was removed")
+		}
+		if b.Get([]byte("stale")) != nil {
+			t.Error("the expired idempotency key was kept")
+		}
+		if b.Get([]byte("interrupted")) != nil {
+			t.Error("the idempotency key without a job was kept")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
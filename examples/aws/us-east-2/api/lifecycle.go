@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How often a running VM's peer port is checked for a destination
+	migrationPollInterval = time.Second
+	// How many polls without a destination end a migration that did not
+	// take the VM over
+	migrationIdlePolls = 5
+)
+
+// phaseTransitions lists the phases a VM may move to from each phase. The
+// empty phase stands for a VM the registry does not know yet.
+var phaseTransitions = map[string][]string{
+	"":                {PhaseCreating, PhaseMigratingIn},
+	PhaseCreating:     {PhaseSnapshotting, PhaseReady, PhaseFailed, PhaseDeleted},
+	PhaseSnapshotting: {PhaseReady, PhaseFailed, PhaseDeleted},
+	PhaseReady:        {PhaseCreating, PhaseStarting, PhaseFailed, PhaseDeleted},
+	PhaseStarting:     {PhaseRunning, PhaseFailed, PhaseDeleted},
+	PhaseRunning:      {PhaseMigratingOut, PhaseStopped, PhaseFailed, PhaseDeleted},
+	PhaseMigratingOut: {PhaseRunning, PhaseStopped, PhaseFailed, PhaseDeleted},
+	PhaseMigratingIn:  {PhaseRunning, PhaseFailed, PhaseDeleted},
+	PhaseStopped:      {PhaseCreating, PhaseStarting, PhaseMigratingIn, PhaseFailed, PhaseDeleted},
+	PhaseFailed:       {PhaseCreating, PhaseMigratingIn, PhaseStopped, PhaseDeleted},
+	PhaseDeleted:      {PhaseCreating, PhaseMigratingIn},
+}
+
+// PhaseTransition is one entry in a VM's phase history
+type PhaseTransition struct {
+	From  string    `json:"from,omitempty"`
+	To    string    `json:"to"`
+	At    time.Time `json:"at"`
+	Cause string    `json:"cause,omitempty"`
+}
+
+// TransitionError is returned when a VM cannot move to the requested phase
+type TransitionError struct {
+	Name string
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	var allowed []string
+	for from, targets := range phaseTransitions {
+		for _, target := range targets {
+			if target == e.To && from != "" {
+				allowed = append(allowed, from)
+			}
+		}
+	}
+	sortPhases(allowed)
+	return fmt.Sprintf("VM %s is %s and cannot move to %s, only VMs that are %s can", e.Name, e.From, e.To, strings.Join(allowed, ", "))
+}
+
+// phaseOrder is the order phases are listed in messages
+var phaseOrder = []string{PhaseCreating, PhaseSnapshotting, PhaseReady, PhaseStarting, PhaseRunning, PhaseMigratingOut, PhaseMigratingIn, PhaseStopped, PhaseFailed, PhaseDeleted}
+
+func sortPhases(phases []string) {
+	rank := make(map[string]int, len(phaseOrder))
+	for i, phase := range phaseOrder {
+		rank[phase] = i
+	}
+	sort.Slice(phases, func(i, j int) bool { return rank[phases[i]] < rank[phases[j]] })
+}
+
+func canTransition(from, to string) bool {
+	for _, target := range phaseTransitions[from] {
+		if target == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the record to a new phase and appends it to the history
+func (rec *VMRecord) transition(to string, cause error) error {
+	if !canTransition(rec.Phase, to) {
+		return &TransitionError{Name: rec.Name, From: rec.Phase, To: to}
+	}
+
+	entry := PhaseTransition{From: rec.Phase, To: to, At: time.Now().UTC()}
+	rec.Error = ""
+	if cause != nil {
+		rec.Error = cause.Error()
+		entry.Cause = rec.Error
+	}
+	rec.Phase = to
+	rec.Transitions = append(rec.Transitions, entry)
+	log.Printf("VM %s: %s -> %s", rec.Name, entry.From, to)
+	return nil
+}
+
+// writeTransitionError answers a request that failed to move a VM to a new
+// phase, with 409 Conflict for illegal transitions
+func writeTransitionError(c *gin.Context, name string, err error) {
+	var transitionErr *TransitionError
+	switch {
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "name": name, "phase": transitionErr.From})
+	case errors.Is(err, ErrVMNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("VM %s not found", name)})
+	default:
+		log.Printf("Error updating VM record %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update VM record: %v", err)})
+	}
+}
+
+// checkTransition rejects a request up front if the VM cannot move to phase
+// from where it is now
+func checkTransition(c *gin.Context, rec *VMRecord, to string) bool {
+	if !canTransition(rec.Phase, to) {
+		writeTransitionError(c, rec.Name, &TransitionError{Name: rec.Name, From: rec.Phase, To: to})
+		return false
+	}
+	return true
+}
+
+// recordProcessExit finishes the snapshot of a VM or blueprint whose
+// snapshotter exits with no job waiting for it, as after an API restart, and
+// the migration of a VM whose peer exits while a destination pulls from it
+func (api *DrafterAPI) recordProcessExit(status ProcessStatus) {
+	if status.VM == "" || (status.Component != "snapshotter" && status.Component != "peer") {
+		return
+	}
+	if _, busy := api.jobs.Active(status.VM); busy {
+		return
+	}
+	if status.Component == "peer" {
+		// Stopping the forwarder waits on the supervisor, which is waiting
+		// for this call to return
+		go api.finishMigrationOut(status.VM, status)
+		return
+	}
+	if name, ok := ownerBlueprint(status.VM); ok {
+		api.finishAdoptedBlueprint(name, status)
+		return
+	}
+
+	rec, err := api.registry.Get(status.VM)
+	if err != nil || rec.Phase != PhaseSnapshotting {
+		// The snapshotter is also stopped by stop and delete
+		return
+	}
+	if _, err := api.finishSnapshot(status.VM, status); err != nil {
+		log.Printf("Snapshot of VM %s failed: %v", status.VM, err)
+		api.failVM(status.VM, err)
+	}
+}
+
+// watchMigrations moves a running VM to migrating-out while a destination is
+// connected to its peer and back to running once the destination has been
+// gone for migrationIdlePolls polls. It follows one run of the peer, and
+// returns once the VM is neither running nor migrating out.
+func (api *DrafterAPI) watchMigrations(name string) {
+	rec, err := api.registry.Get(name)
+	if err != nil {
+		return
+	}
+	peer, port := rec.PIDs["peer"], rec.Ports[PortPeer]
+	if peer == 0 || port == 0 {
+		return
+	}
+
+	idle := 0
+	for {
+		time.Sleep(migrationPollInterval)
+		rec, err := api.registry.Get(name)
+		if err != nil || rec.PIDs["peer"] != peer || (rec.Phase != PhaseRunning && rec.Phase != PhaseMigratingOut) {
+			return
+		}
+		if _, busy := api.jobs.Active(name); busy {
+			continue
+		}
+
+		switch connected := portConnected(port); {
+		case connected && rec.Phase == PhaseRunning:
+			log.Printf("VM %s: a destination connected to its peer on port %d", name, port)
+			api.movePhase(name, PhaseRunning, PhaseMigratingOut)
+			idle = 0
+		case connected:
+			idle = 0
+		case rec.Phase == PhaseMigratingOut:
+			if idle++; idle >= migrationIdlePolls {
+				log.Printf("VM %s: the destination left without taking over the VM", name)
+				api.movePhase(name, PhaseMigratingOut, PhaseRunning)
+				idle = 0
+			}
+		}
+	}
+}
+
+// movePhase moves a VM from one phase to another, unless something else
+// has moved it in the meantime
+func (api *DrafterAPI) movePhase(name, from, to string) {
+	_, err := api.registry.Update(name, func(rec *VMRecord) error {
+		if rec.Phase != from {
+			return &TransitionError{Name: name, From: rec.Phase, To: to}
+		}
+		return rec.transition(to, nil)
+	})
+	if err != nil {
+		log.Printf("Error moving VM %s to %s: %v", name, to, err)
+	}
+}
+
+// finishMigrationOut stops a VM whose peer exited while a destination was
+// pulling from it. A clean exit means the destination took the VM over.
+func (api *DrafterAPI) finishMigrationOut(name string, status ProcessStatus) {
+	rec, err := api.registry.Get(name)
+	if err != nil || rec.Phase != PhaseMigratingOut {
+		return
+	}
+	if _, err := api.stopVMProcesses(rec, api.config.StopGracePeriod); err != nil {
+		log.Printf("Error stopping VM %s after it migrated out: %v", name, err)
+		api.failVM(name, err)
+		return
+	}
+
+	to := PhaseStopped
+	var cause error
+	if status.Signal != "" || (status.ExitCode != nil && *status.ExitCode != 0) {
+		to = PhaseFailed
+		cause = fmt.Errorf("peer exited during migration: %s", exitDescription(status))
+	}
+	if _, err := api.registry.Transition(name, to, cause, func(rec *VMRecord) error {
+		for _, component := range stopOrder {
+			delete(rec.PIDs, component)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Error updating VM record %s: %v", name, err)
+		return
+	}
+
+	if err := api.netns.Release(name); err != nil {
+		log.Printf("Error releasing netns: %v", err)
+	}
+	if err := api.ports.Release(name); err != nil {
+		log.Printf("Error releasing ports: %v", err)
+	}
+	log.Printf("VM %s migrated out", name)
+}
+
+func exitDescription(status ProcessStatus) string {
+	description := status.Error
+	if status.Signal != "" {
+		description = "killed by " + status.Signal
+	} else if status.ExitCode != nil {
+		description = "exit code " + strconv.Itoa(*status.ExitCode)
+	}
+	if tail := strings.TrimSpace(status.StderrTail); tail != "" {
+		description += ": " + tail
+	}
+	return description
+}
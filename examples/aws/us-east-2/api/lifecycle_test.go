@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPhaseTransitionsCoverEveryPhase(t *testing.T) {
+	known := map[string]bool{"": true}
+	for _, phase := range phaseOrder {
+		known[phase] = true
+		if _, ok := phaseTransitions[phase]; !ok {
+			t.Errorf("phase %s has no transitions", phase)
+		}
+	}
+	for from, targets := range phaseTransitions {
+		if !known[from] {
+			t.Errorf("transitions from unknown phase %q", from)
+		}
+		for _, to := range targets {
+			if to == "" || !known[to] {
+				t.Errorf("transition from %q to unknown phase %q", from, to)
+			}
+		}
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"", PhaseCreating, true},
+		{"", PhaseMigratingIn, true},
+		{"", PhaseRunning, false},
+		{PhaseReady, PhaseStarting, true},
+		{PhaseStarting, PhaseRunning, true},
+		{PhaseRunning, PhaseStarting, false},
+		{PhaseRunning, PhaseMigratingOut, true},
+		{PhaseMigratingIn, PhaseStopped, false},
+		{PhaseFailed, PhaseStarting, false},
+		{PhaseFailed, PhaseStopped, true},
+		{PhaseDeleted, PhaseCreating, true},
+		{PhaseDeleted, PhaseStarting, false},
+		{"unknown", PhaseDeleted, false},
+	}
+	for _, tt := range tests {
+		if got := canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	// Any VM the registry knows can be deleted
+	for _, phase := range phaseOrder {
+		if phase != PhaseDeleted && !canTransition(phase, PhaseDeleted) {
+			t.Errorf("a %s VM cannot be deleted", phase)
+		}
+	}
+}
+
+func TestRecordTransition(t *testing.T) {
+	rec := &VMRecord{Name: "vm", Phase: PhaseReady, Error: "old"}
+	if err := rec.transition(PhaseStarting, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.transition(PhaseFailed, errors.New("peer exited")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhaseFailed || rec.Error != "peer exited" {
+		t.Errorf("record is %s with error %q, want failed with the cause", rec.Phase, rec.Error)
+	}
+	if len(rec.Transitions) != 2 {
+		t.Fatalf("history has %d entries, want 2", len(rec.Transitions))
+	}
+	if got := rec.Transitions[1]; got.From != PhaseStarting || got.To != PhaseFailed || got.Cause != "peer exited" {
+		t.Errorf("last transition = %+v", got)
+	}
+
+	err := rec.transition(PhaseRunning, nil)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) {
+		t.Fatalf("transition from failed to running returned %v, want a TransitionError", err)
+	}
+	if rec.Phase != PhaseFailed || len(rec.Transitions) != 2 {
+		t.Error("an illegal transition changed the record")
+	}
+	// The message names the phases that could have moved to running
+	if msg := err.Error(); !strings.Contains(msg, "starting, migrating-out, migrating-in") {
+		t.Errorf("error %q does not list the allowed phases in order", msg)
+	}
+}
+
+func TestRegistryRestore(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	// A new VM whose create could not be queued is removed
+	if _, err := reg.Replace(&VMRecord{Name: "new"}, PhaseCreating); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Restore("new", PhaseCreating, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Get("new"); !errors.Is(err, ErrVMNotFound) {
+		t.Errorf("Get(new) = %v, want ErrVMNotFound", err)
+	}
+
+	// A VM whose start could not be queued goes back to ready
+	if err := reg.Put(&VMRecord{Name: "vm", Phase: PhaseReady}); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := reg.Get("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Transition("vm", PhaseStarting, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Restore("vm", PhaseStarting, previous); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := reg.Get("vm"); err != nil || rec.Phase != PhaseReady {
+		t.Errorf("Get(vm) = %v, %v, want a ready VM", rec, err)
+	}
+
+	// A VM that has moved on is left alone
+	if _, err := reg.Transition("vm", PhaseStarting, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Transition("vm", PhaseRunning, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Restore("vm", PhaseStarting, previous); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := reg.Get("vm"); err != nil || rec.Phase != PhaseRunning {
+		t.Errorf("Get(vm) = %v, %v, want a running VM", rec, err)
+	}
+}
+
+func TestFinishMigrationOut(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	api := &DrafterAPI{
+		config:     DefaultConfig(),
+		registry:   reg,
+		netns:      NewNetnsAllocator(reg, "ark", 4),
+		ports:      NewPortAllocator(reg),
+		supervisor: NewSupervisor(),
+		jobs:       NewJobManager(reg, 0),
+	}
+
+	for i, name := range []string{"moved", "crashed", "running"} {
+		phase := PhaseMigratingOut
+		if name == "running" {
+			phase = PhaseRunning
+		}
+		rec := &VMRecord{
+			Name:  name,
+			Phase: phase,
+			Netns: fmt.Sprintf("ark%d", i),
+			Ports: map[string]int{PortPeer: 1337 + i},
+			PIDs:  map[string]int{"peer": 1 << 30, "forwarder": 1 << 30},
+		}
+		if err := reg.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clean, failed := 0, 1
+	api.finishMigrationOut("moved", ProcessStatus{VM: "moved", Component: "peer", ExitCode: &clean})
+	api.finishMigrationOut("crashed", ProcessStatus{VM: "crashed", Component: "peer", ExitCode: &failed})
+	api.finishMigrationOut("running", ProcessStatus{VM: "running", Component: "peer", ExitCode: &clean})
+
+	rec, err := reg.Get("moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhaseStopped || rec.Netns != "" || len(rec.Ports) != 0 || len(rec.PIDs) != 0 {
+		t.Errorf("migrated VM is %s with netns %q, ports %v and pids %v, want stopped with everything released", rec.Phase, rec.Netns, rec.Ports, rec.PIDs)
+	}
+	if rec, err := reg.Get("crashed"); err != nil || rec.Phase != PhaseFailed || !strings.Contains(rec.Error, "exit code 1") {
+		t.Errorf("VM whose peer failed mid-migration = %+v, %v, want failed with the exit code", rec, err)
+	}
+	// A peer that exits while nothing migrates is not taken as a migration
+	if rec, err := reg.Get("running"); err != nil || rec.Phase != PhaseRunning || rec.Netns != "ark2" {
+		t.Errorf("running VM = %+v, %v, want it untouched", rec, err)
+	}
+}
+
+func TestMovePhase(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg}
+	if err := reg.Put(&VMRecord{Name: "vm", Phase: PhaseRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	api.movePhase("vm", PhaseRunning, PhaseMigratingOut)
+	// The VM was stopped meanwhile, so it is not moved back to running
+	if _, err := reg.Transition("vm", PhaseStopped, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	api.movePhase("vm", PhaseMigratingOut, PhaseRunning)
+
+	rec, err := reg.Get("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var phases []string
+	for _, transition := range rec.Transitions {
+		phases = append(phases, transition.To)
+	}
+	if want := []string{PhaseMigratingOut, PhaseStopped}; rec.Phase != PhaseStopped || strings.Join(phases, ",") != strings.Join(want, ",") {
+		t.Errorf("VM moved through %v, want %v", phases, want)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// listSortKeys maps the sort parameter to the value records are ordered by
+var listSortKeys = map[string]func(rec *VMRecord) string{
+	"name":       func(rec *VMRecord) string { return rec.Name },
+	"phase":      func(rec *VMRecord) string { return rec.Phase },
+	"created_at": func(rec *VMRecord) string { return rec.CreatedAt.UTC().Format(time.RFC3339Nano) },
+	"updated_at": func(rec *VMRecord) string { return rec.UpdatedAt.UTC().Format(time.RFC3339Nano) },
+}
+
+// VMSummary is the per-VM entry returned by GET /vms
+type VMSummary struct {
+	Name      string            `json:"name"`
+	Phase     string            `json:"phase"`
+	Memory    string            `json:"memory"`
+	Workload  string            `json:"workload"`
+	Source    string            `json:"source,omitempty"`
+	Netns     string            `json:"netns,omitempty"`
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// listCursor marks the last VM of a page. It is handed to clients as an
+// opaque base64 string and only valid with the same sort and order.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Key   string `json:"k"`
+	Name  string `json:"n"`
+}
+
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (listCursor, error) {
+	var cursor listCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// labelSelector matches key=value pairs, or just the presence of key
+type labelSelector struct {
+	key   string
+	value string
+	any   bool
+}
+
+func parseLabelSelectors(values []string) ([]labelSelector, error) {
+	var selectors []labelSelector
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(part, "=")
+			if key == "" {
+				return nil, fmt.Errorf("invalid label selector %q", part)
+			}
+			selectors = append(selectors, labelSelector{key: key, value: val, any: !ok})
+		}
+	}
+	return selectors, nil
+}
+
+func matchesLabels(labels map[string]string, selectors []labelSelector) bool {
+	for _, selector := range selectors {
+		value, ok := labels[selector.key]
+		if !ok || (!selector.any && value != selector.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (api *DrafterAPI) listVMs(c *gin.Context) {
+	sortBy := c.DefaultQuery("sort", "name")
+	sortKey, ok := listSortKeys[sortBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid sort %q, must be one of name, phase, created_at, updated_at", sortBy)})
+		return
+	}
+
+	order := c.DefaultQuery("order", "asc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid order %q, must be asc or desc", order)})
+		return
+	}
+
+	limit := defaultListLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q, must be between 1 and %d", value, maxListLimit)})
+			return
+		}
+		limit = parsed
+	}
+
+	var after *listCursor
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if cursor.Sort != sortBy || cursor.Order != order {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor was issued for a different sort or order"})
+			return
+		}
+		after = &cursor
+	}
+
+	phases := make(map[string]bool)
+	for _, value := range c.QueryArray("phase") {
+		for _, phase := range strings.Split(value, ",") {
+			if phase = strings.TrimSpace(phase); phase != "" {
+				phases[phase] = true
+			}
+		}
+	}
+
+	selectors, err := parseLabelSelectors(c.QueryArray("label"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	records, err := api.registry.List()
+	if err != nil {
+		log.Printf("Error listing VMs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list VMs: %v", err)})
+		return
+	}
+
+	var matched []*VMRecord
+	for _, rec := range records {
+		// Deleted VMs are only listed when asked for
+		if len(phases) > 0 && !phases[rec.Phase] || len(phases) == 0 && rec.Phase == PhaseDeleted {
+			continue
+		}
+		if !matchesLabels(rec.Config.Labels, selectors) {
+			continue
+		}
+		matched = append(matched, rec)
+	}
+
+	// Order by the sort key with the name as a tie breaker, so the cursor
+	// always identifies a unique position
+	less := func(aKey, aName, bKey, bName string) bool {
+		if aKey != bKey {
+			return aKey < bKey
+		}
+		return aName < bName
+	}
+	if order == "desc" {
+		asc := less
+		less = func(aKey, aName, bKey, bName string) bool { return asc(bKey, bName, aKey, aName) }
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return less(sortKey(matched[i]), matched[i].Name, sortKey(matched[j]), matched[j].Name)
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return less(after.Key, after.Name, sortKey(matched[i]), matched[i].Name)
+		})
+	}
+
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	page := matched[start:end]
+
+	vms := make([]VMSummary, 0, len(page))
+	for _, rec := range page {
+		vms = append(vms, VMSummary{
+			Name:      rec.Name,
+			Phase:     rec.Phase,
+			Memory:    rec.Config.Memory,
+			Workload:  rec.Config.workload(api.config.Artifacts.defaultWorkload()).Name,
+			Source:    rec.Source,
+			Netns:     rec.Netns,
+			Endpoints: api.endpoints(rec),
+			Labels:    rec.Config.Labels,
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+
+	response := gin.H{"vms": vms, "total": len(matched)}
+	if end < len(matched) {
+		last := page[len(page)-1]
+		response["next_cursor"] = encodeCursor(listCursor{Sort: sortBy, Order: order, Key: sortKey(last), Name: last.Name})
+	}
+	c.JSON(http.StatusOK, response)
+}
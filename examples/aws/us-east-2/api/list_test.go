@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := listCursor{Sort: "created_at", Order: "desc", Key: "2024-01-02T03:04:05Z", Name: "vm-1"}
+	got, err := decodeCursor(encodeCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cursor {
+		t.Errorf("decodeCursor() = %+v, want %+v", got, cursor)
+	}
+
+	for _, value := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(value); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+// newListAPI serves GET /vms from a registry holding a VM per name and phase
+func newListAPI(t *testing.T, phases map[string]string) *gin.Engine {
+	t.Helper()
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reg.Close() })
+	for name, phase := range phases {
+		if err := reg.Put(&VMRecord{Name: name, Phase: phase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := &DrafterAPI{config: DefaultConfig(), registry: reg}
+	router.GET("/vms", api.listVMs)
+	return router
+}
+
+type listPage struct {
+	VMs        []VMSummary `json:"vms"`
+	Total      int         `json:"total"`
+	NextCursor string      `json:"next_cursor"`
+	Error      string      `json:"error"`
+}
+
+func getList(t *testing.T, router *gin.Engine, query string) (int, listPage) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/vms?"+query, nil))
+	var page listPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+	}
+	return w.Code, page
+}
+
+// listAll follows the cursors from the first page to the last
+func listAll(t *testing.T, router *gin.Engine, query string) []string {
+	t.Helper()
+	var names []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		code, page := getList(t, router, query+"&cursor="+cursor)
+		if code != http.StatusOK {
+			t.Fatalf("GET /vms?%s returned %d: %s", query, code, page.Error)
+		}
+		for _, vm := range page.VMs {
+			names = append(names, vm.Name)
+		}
+		if page.NextCursor == "" {
+			return names
+		}
+		cursor = page.NextCursor
+	}
+	t.Fatal("cursors did not reach the last page")
+	return nil
+}
+
+func TestListVMsPaging(t *testing.T) {
+	router := newListAPI(t, map[string]string{
+		"a": PhaseRunning,
+		"b": PhaseReady,
+		"c": PhaseRunning,
+		"d": PhaseStopped,
+		"e": PhaseReady,
+		"f": PhaseRunning,
+		"g": PhaseDeleted,
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"limit=2", []string{"a", "b", "c", "d", "e", "f"}},
+		{"limit=4&order=desc", []string{"f", "e", "d", "c", "b", "a"}},
+		// Names break the ties between VMs in the same phase
+		{"limit=2&sort=phase", []string{"b", "e", "a", "c", "f", "d"}},
+		{"limit=1&sort=phase&order=desc", []string{"d", "f", "c", "a", "e", "b"}},
+		{"limit=2&phase=running,deleted", []string{"a", "c", "f", "g"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := listAll(t, router, tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListVMsCursorMismatch(t *testing.T) {
+	router := newListAPI(t, map[string]string{"a": PhaseReady, "b": PhaseReady})
+
+	_, page := getList(t, router, "limit=1")
+	if page.NextCursor == "" || page.Total != 2 {
+		t.Fatalf("first page = %+v, want a cursor and a total of 2", page)
+	}
+	for _, query := range []string{
+		"sort=phase&cursor=" + page.NextCursor,
+		"order=desc&cursor=" + page.NextCursor,
+		"cursor=garbage",
+	} {
+		if code, _ := getList(t, router, query); code != http.StatusBadRequest {
+			t.Errorf("GET /vms?%s returned %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListVMsLimit(t *testing.T) {
+	router := newListAPI(t, nil)
+	for _, limit := range []string{"0", "-1", fmt.Sprint(maxListLimit + 1), "ten"} {
+		if code, _ := getList(t, router, "limit="+limit); code != http.StatusBadRequest {
+			t.Errorf("limit=%s returned %d, want %d", limit, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -2,21 +2,39 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type DrafterAPI struct {
-	router *gin.Engine
+	router   *gin.Engine
+	config   Config
+	registry *Registry
+	netns    *NetnsAllocator
+	ports    *PortAllocator
+
+	supervisor *Supervisor
+	jobs       *JobManager
+
+	// natMu makes checking for and starting drafter-nat one step, so jobs
+	// running in parallel start it only once
+	natMu sync.Mutex
 }
 
 type LogManager struct {
@@ -26,15 +44,29 @@ type LogManager struct {
 }
 
 type VMConfig struct {
-	Name      string `json:"name"`
-	Memory    string `json:"memory"`
-	CPUs      int    `json:"cpus"`
-	DiskSize  string `json:"disk_size"`
-	ImagePath string `json:"image_path"`
+	Name string `json:"name"`
+	PackageSpec
+
+	// Blueprint names a built blueprint to create the VM from
+	Blueprint string `json:"blueprint,omitempty"`
+
+	// Tuning controls how the VM's devices are migrated
+	Tuning *MigrationTuning `json:"tuning,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// workload returns the workload the VM was created with. VMs created before
+// workloads were recorded run Valkey, the fallback.
+func (c VMConfig) workload(fallback Workload) Workload {
+	if c.Workload != nil {
+		return *c.Workload
+	}
+	return fallback
 }
 
-func NewLogManager(vmName string) (*LogManager, error) {
-	baseDir := filepath.Join("/home/ec2-user/drafter-api/logs", vmName, time.Now().Format("2006-01-02_15-04-05"))
+func NewLogManager(logRoot, vmName string) (*LogManager, error) {
+	baseDir := filepath.Join(logRoot, vmName, time.Now().Format("2006-01-02_15-04-05"))
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %v", err)
 	}
@@ -47,8 +79,7 @@ func NewLogManager(vmName string) (*LogManager, error) {
 }
 
 func (lm *LogManager) GetLogger(component string) (*log.Logger, error) {
-	logPath := filepath.Join(lm.baseDir, fmt.Sprintf("%s.log", component))
-	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(lm.LogPath(component), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open log file: %v", err)
 	}
@@ -57,6 +88,11 @@ func (lm *LogManager) GetLogger(component string) (*log.Logger, error) {
 	return log.New(f, fmt.Sprintf("[%s] ", component), log.LstdFlags|log.Lmsgprefix), nil
 }
 
+// LogPath returns the log file a component's process output is appended to
+func (lm *LogManager) LogPath(component string) string {
+	return filepath.Join(lm.baseDir, fmt.Sprintf("%s.log", component))
+}
+
 func (lm *LogManager) Close() {
 	for _, f := range lm.logFiles {
 		f.Close()
@@ -64,7 +100,7 @@ func (lm *LogManager) Close() {
 }
 
 func (api *DrafterAPI) setupLogging(vmName string) (*LogManager, error) {
-	return NewLogManager(vmName)
+	return NewLogManager(api.config.LogRoot, vmName)
 }
 
 func runCommandWithOutput(cmd *exec.Cmd) (string, error) {
@@ -88,10 +124,19 @@ func runCommandWithOutput(cmd *exec.Cmd) (string, error) {
 	return output, nil
 }
 
-func NewDrafterAPI() *DrafterAPI {
+func NewDrafterAPI(config Config, registry *Registry) *DrafterAPI {
 	api := &DrafterAPI{
-		router: gin.Default(),
+		router:   gin.Default(),
+		config:   config,
+		registry: registry,
+		netns:    NewNetnsAllocator(registry, config.NetnsPrefix, config.NetnsPoolSize),
+		ports:    NewPortAllocator(registry),
+
+		supervisor: NewSupervisor(),
+		jobs:       NewJobManager(registry, config.JobWorkers),
 	}
+	api.supervisor.OnStart = api.recordProcessStart
+	api.supervisor.OnExit = api.recordProcessExit
 	api.setupRoutes()
 	return api
 }
@@ -102,9 +147,104 @@ func (api *DrafterAPI) setupRoutes() {
 	api.router.POST("/vm/stop/:name", api.stopVM)
 	api.router.GET("/vm/status/:name", api.getVMStatus)
 	api.router.POST("/vm/migrate/:name", api.migrateVM)
+	api.router.DELETE("/vm/:name", api.deleteVM)
+	api.router.POST("/vm/:name/clone", api.cloneVM)
+	api.router.GET("/vms", api.listVMs)
+	api.router.GET("/jobs/:id", api.getJob)
+	api.router.POST("/blueprints", api.createBlueprint)
+	api.router.GET("/blueprints", api.listBlueprints)
+	api.router.GET("/blueprints/:name", api.getBlueprint)
+	api.router.GET("/host", api.getHostInfo)
+	api.router.POST("/workloads", api.createWorkload)
+	api.router.GET("/workloads", api.listWorkloads)
+	api.router.GET("/workloads/:name", api.getWorkload)
+}
+
+// lookupVM loads a VM record and writes the error response if it cannot
+func (api *DrafterAPI) lookupVM(c *gin.Context, name string) (*VMRecord, bool) {
+	record, err := api.registry.Get(name)
+	if errors.Is(err, ErrVMNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("VM %s not found", name)})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error reading VM record %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read VM record: %v", err)})
+		return nil, false
+	}
+	return record, true
+}
+
+// checkNotBusy rejects requests for a VM that already has a job in flight
+func (api *DrafterAPI) checkNotBusy(c *gin.Context, name string) bool {
+	if id, busy := api.jobs.Active(name); busy {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s has job %s in progress", name, id), "job_id": id})
+		return false
+	}
+	return true
+}
+
+// failVM records a failed operation on a VM
+func (api *DrafterAPI) failVM(name string, cause error) {
+	if _, err := api.registry.Transition(name, PhaseFailed, cause, nil); err != nil {
+		log.Printf("Error marking VM %s as failed: %v", name, err)
+	}
 }
 
-func (api *DrafterAPI) downloadAndVerifyFile(url, outputPath string) error {
+// abortStart fails a VM whose start or migration went wrong part way. The
+// components it started are stopped and its netns and ports released, unless
+// something could not be stopped and still holds them.
+func (api *DrafterAPI) abortStart(name string, cause error) {
+	rec, err := api.registry.Get(name)
+	if err != nil {
+		log.Printf("Error reading VM record: %v", err)
+		api.failVM(name, cause)
+		return
+	}
+	if _, err := api.stopVMProcesses(rec, api.config.StopGracePeriod); err != nil {
+		log.Printf("Error stopping VM %s after a failed start: %v", name, err)
+		api.failVM(name, cause)
+		return
+	}
+	if err := api.netns.Release(name); err != nil {
+		log.Printf("Error releasing netns: %v", err)
+	}
+	if err := api.ports.Release(name); err != nil {
+		log.Printf("Error releasing ports: %v", err)
+	}
+	api.failVM(name, cause)
+}
+
+// progressReader reports how many bytes have been read so far
+type progressReader struct {
+	reader   io.Reader
+	read     int64
+	total    int64
+	progress func(read, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.read += int64(n)
+	if p.progress != nil {
+		p.progress(p.read, p.total)
+	}
+	return n, err
+}
+
+// downloadProgress maps a download's progress onto a slice of the current
+// job phase starting at offset and spanning share of it
+func downloadProgress(run *JobRun, offset, share float64, what string) func(read, total int64) {
+	return func(read, total int64) {
+		if total <= 0 {
+			run.Progress(offset, fmt.Sprintf("downloaded %d bytes of %s", read, what))
+			return
+		}
+		run.Progress(offset+share*float64(read)/float64(total), fmt.Sprintf("downloaded %d of %d bytes of %s", read, total, what))
+	}
+}
+
+func (api *DrafterAPI) downloadAndVerifyFile(url, outputPath string, progress func(read, total int64)) error {
 	log.Printf("Starting download from: %s", url)
 
 	// Create a custom HTTP client with longer timeout
@@ -135,7 +275,7 @@ func (api *DrafterAPI) downloadAndVerifyFile(url, outputPath string) error {
 	defer out.Close()
 
 	// Copy the response body to the file
-	written, err := io.Copy(out, resp.Body)
+	written, err := io.Copy(out, &progressReader{reader: resp.Body, total: resp.ContentLength, progress: progress})
 	if err != nil {
 		return fmt.Errorf("failed to write file: %v", err)
 	}
@@ -170,127 +310,332 @@ func min(a, b int) int {
 	return b
 }
 
+var createPhases = []string{"prepare", "download", "extract", "resize", "nat", "snapshot", "verify"}
+
 func (api *DrafterAPI) createVM(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
 	var config VMConfig
 	if err := c.BindJSON(&config); err != nil {
 		log.Printf("Error parsing request: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// Add this logging setup right here
-	logManager, err := api.setupLogging(config.Name)
-	if err != nil {
-		log.Printf("Error setting up logging: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to setup logging: %v", err)})
+	if err := validateVMName(config.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := config.Tuning.Resolve(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := api.registeredWorkload(&config.PackageSpec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer logManager.Close()
 
-	// Get loggers for different components
-	natLogger, err := logManager.GetLogger("nat")
-	if err != nil {
-		log.Printf("Error creating NAT logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create NAT logger: %v", err)})
+	var blueprint *Blueprint
+	if config.Blueprint != "" {
+		var ok bool
+		if blueprint, ok = api.readyBlueprint(c, &config); !ok {
+			return
+		}
+	} else if opts, err := config.PackageSpec.Resolve(api.config.Artifacts.defaultWorkload()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
+	} else {
+		// Record the workload and CPU template the VM will run with,
+		// defaults and all
+		config.Workload = &opts.Workload
+		config.CPUTemplate = opts.CPUTemplate
 	}
 
-	snapshotLogger, err := logManager.GetLogger("snapshotter")
-	if err != nil {
-		log.Printf("Error creating snapshotter logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create snapshotter logger: %v", err)})
+	replace := false
+	if value := c.Query("replace"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid replace value %q", value)})
+			return
+		}
+		replace = parsed
+	}
+
+	// A retry with the same Idempotency-Key gets the original job back
+	// instead of starting over
+	key := c.GetHeader(idempotencyHeader)
+	if len(key) > maxIdempotencyKeyLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be at most %d characters", idempotencyHeader, maxIdempotencyKeyLen)})
+		return
+	}
+	submitted := false
+	if key != "" {
+		fingerprint := requestFingerprint(c, body)
+		existing, claimed, err := api.registry.ClaimIdempotencyKey(&idempotencyEntry{Key: key, VM: config.Name, Request: fingerprint})
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check %s: %v", idempotencyHeader, err)})
+			return
+		}
+		if !claimed {
+			api.replayIdempotent(c, existing, fingerprint)
+			return
+		}
+		defer func() {
+			if submitted {
+				return
+			}
+			if err := api.registry.ReleaseIdempotencyKey(key); err != nil {
+				log.Printf("Error releasing idempotency key %s: %v", key, err)
+			}
+		}()
+	}
+
+	if !api.checkNotBusy(c, config.Name) {
 		return
 	}
 
-	// Use /home/ec2-user as the base directory
-	baseOutDir := "/home/ec2-user/out"
-	blueprintDir := filepath.Join(baseOutDir, "blueprint")
-	packageDir := filepath.Join(baseOutDir, "package")
-	instanceDir := filepath.Join(baseOutDir, fmt.Sprintf("instance-0", config.Name))
-	overlayDir := filepath.Join(instanceDir, "overlay")
-	stateDir := filepath.Join(instanceDir, "state")
+	existing, err := api.registry.Get(config.Name)
+	if err != nil && !errors.Is(err, ErrVMNotFound) {
+		log.Printf("Error reading VM record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read VM record: %v", err)})
+		return
+	}
+	if err == nil && existing.Phase != PhaseDeleted {
+		if !replace {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s already exists, pass replace=true to replace it", config.Name), "name": config.Name, "phase": existing.Phase})
+			return
+		}
+		if vmActive(existing) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("VM %s is %s, stop it before replacing it", config.Name, existing.Phase), "name": config.Name, "phase": existing.Phase})
+			return
+		}
+		if !api.checkNoClones(c, config.Name) {
+			return
+		}
+		log.Printf("Replacing VM %s, which is %s", config.Name, existing.Phase)
+	}
+
+	// Every VM gets its own tree under the data root keyed by its name
+	record := &VMRecord{
+		Name:   config.Name,
+		Config: config,
+	}
+	api.config.setVMPaths(record)
+
+	// A VM from a blueprint skips straight to ready
+	phases, fn := createPhases, func(run *JobRun) (gin.H, error) {
+		return api.runCreate(run, record)
+	}
+	if blueprint != nil {
+		useBlueprint(record, blueprint)
+		phases, fn = blueprintCreatePhases, func(run *JobRun) (gin.H, error) {
+			return api.runCreateFromBlueprint(run, config.Name)
+		}
+	}
 
 	log.Printf("Creating VM: %s", config.Name)
-	log.Printf("Using directories: base=%s, blueprint=%s", baseOutDir, blueprintDir)
+	log.Printf("Using directories: base=%s, blueprint=%s, package=%s", record.BaseDir, record.BlueprintDir, record.PackageDir)
+	previous, err := api.registry.Replace(record, PhaseCreating)
+	if err != nil {
+		writeTransitionError(c, config.Name, err)
+		return
+	}
 
-	// Clean up existing directories if they exist
-	if err := os.RemoveAll(baseOutDir); err != nil {
+	job, ok := api.submitJob(c, "create", config.Name, phases, fn)
+	if !ok {
+		api.restoreVM(config.Name, PhaseCreating, previous)
+		return
+	}
+
+	submitted = true
+	if key != "" {
+		if err := api.registry.SetIdempotencyJob(key, job.ID); err != nil {
+			log.Printf("Error recording job of idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+func (api *DrafterAPI) runCreate(run *JobRun, record *VMRecord) (result gin.H, err error) {
+	config := record.Config
+	vmDir := record.BaseDir
+	blueprintDir := record.BlueprintDir
+
+	// Mark the VM as failed if any step below bails out
+	defer func() {
+		if err != nil {
+			api.failVM(config.Name, err)
+			if releaseErr := api.netns.Release(config.Name); releaseErr != nil {
+				log.Printf("Error releasing netns of VM %s: %v", config.Name, releaseErr)
+			}
+		}
+	}()
+
+	run.Phase("prepare")
+	logManager, err := api.setupLogging(config.Name)
+	if err != nil {
+		log.Printf("Error setting up logging: %v", err)
+		return nil, fmt.Errorf("failed to setup logging: %v", err)
+	}
+	defer logManager.Close()
+
+	if _, err := api.registry.Update(config.Name, func(rec *VMRecord) error {
+		rec.LogsPath = logManager.baseDir
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
+	}
+
+	// Clean up this VM's directories if they exist, leaving other VMs alone
+	if err := os.RemoveAll(vmDir); err != nil {
 		log.Printf("Error cleaning up existing directories: %v", err)
 	}
 
 	// Create all directories
-	dirs := []string{blueprintDir, packageDir, overlayDir, stateDir}
+	dirs := []string{blueprintDir, record.PackageDir, record.OverlayDir, record.StateDir}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Printf("Error creating directory %s: %v", dir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create directory %s: %v", dir, err)})
-			return
+			return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
 		}
 	}
 
 	// Set proper permissions
-	chownCmd := exec.Command("sudo", "chown", "-R", "ec2-user:ec2-user", baseOutDir)
-	if err := chownCmd.Run(); err != nil {
+	if err := api.config.chownToServiceUser(vmDir); err != nil {
 		log.Printf("Error setting permissions: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to set permissions: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to set permissions: %v", err)
 	}
 
-	// Download DrafterOS with explicit version
-	drafterosPath := filepath.Join(baseOutDir, "drafteros-oci.tar.zst")
-	// Use a specific version instead of latest
-	downloadURL := fmt.Sprintf("https://github.com/loopholelabs/drafter/releases/download/v0.5.0/drafteros-oci-x86_64_pvm.tar.zst")
-	fmt.Println(downloadURL)
-	if err := api.downloadAndVerifyFile(downloadURL, drafterosPath); err != nil {
-		log.Printf("Error downloading DrafterOS: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to download DrafterOS: %v", err)})
-		return
+	if err := prepareHost(); err != nil {
+		return nil, err
 	}
 
-	// Download Valkey OCI with explicit version
-	valkeyPath := filepath.Join(baseOutDir, "oci-valkey.tar.zst")
-	valkeyURL := fmt.Sprintf("https://github.com/loopholelabs/drafter/releases/download/v0.5.0/oci-valkey-x86_64.tar.zst")
-	if err := api.downloadAndVerifyFile(valkeyURL, valkeyPath); err != nil {
-		log.Printf("Error downloading Valkey OCI: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to download Valkey OCI: %v", err)})
-		return
+	opts, err := config.PackageSpec.Resolve(api.config.Artifacts.defaultWorkload())
+	if err != nil {
+		return nil, err
 	}
 
-	// Verify downloaded files
-	log.Printf("Verifying downloaded files...")
-	if _, err := os.Stat(drafterosPath); err != nil {
-		log.Printf("DrafterOS file not found: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DrafterOS file missing after download"})
-		return
+	if err := api.fetchArtifacts(run, vmDir, blueprintDir, opts.Workload); err != nil {
+		return nil, err
 	}
-	if _, err := os.Stat(valkeyPath); err != nil {
-		log.Printf("Valkey file not found: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Valkey file missing after download"})
-		return
+	if opts.DiskSize > 0 {
+		if err := growDisks(run, blueprintDir, opts.DiskSize); err != nil {
+			return nil, err
+		}
+	}
+
+	run.Phase("nat")
+
+	// Start NAT service, which is shared by every VM on the host
+	if err := api.ensureNAT(logManager); err != nil {
+		log.Printf("Error starting NAT service: %v", err)
+		return nil, fmt.Errorf("failed to start NAT service: %v", err)
+	}
+
+	netns, err := api.netns.Acquire(config.Name)
+	if err != nil {
+		log.Printf("Error allocating netns: %v", err)
+		return nil, fmt.Errorf("failed to allocate network namespace: %v", err)
+	}
+
+	run.Phase("snapshot")
+
+	if _, err := api.registry.Transition(config.Name, PhaseSnapshotting, nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
 	}
 
+	status, err := api.runSnapshotter(run, config.Name, netns, opts, blueprintDir, record.PackageDir, logManager)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Phase("verify")
+	sizes, err := api.finishSnapshot(config.Name, status)
+	if err != nil {
+		logSnapshotError(logManager, err)
+		return gin.H{"name": config.Name, "files": sizes}, err
+	}
+
+	log.Printf("VM created successfully: %s", config.Name)
+	return gin.H{
+		"message":   "VM created",
+		"name":      config.Name,
+		"phase":     PhaseReady,
+		"files":     sizes,
+		"logs_path": logManager.baseDir,
+	}, nil
+}
+
+// prepareHost sets up the sudo path and the NBD devices drafter needs
+func prepareHost() error {
 	// Configure sudo path
 	sudoPathCmd := exec.Command("sudo", "tee", "/etc/sudoers.d/preserve_path")
 	sudoPathCmd.Stdin = strings.NewReader("Defaults    secure_path = /sbin:/bin:/usr/sbin:/usr/bin:/usr/local/bin:/usr/local/sbin\n")
 	if err := sudoPathCmd.Run(); err != nil {
 		log.Printf("Error configuring sudo path: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to configure sudo path: %v", err)})
-		return
+		return fmt.Errorf("failed to configure sudo path: %v", err)
 	}
 
 	// Load NBD module
 	if err := exec.Command("sudo", "modprobe", "nbd", "nbds_max=4096").Run(); err != nil {
 		log.Printf("Error loading NBD module: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to load NBD module: %v", err)})
-		return
+		return fmt.Errorf("failed to load NBD module: %v", err)
+	}
+	return nil
+}
+
+// fetchArtifacts downloads the DrafterOS release into dir and extracts its
+// devices into blueprintDir, along with the OCI device of the workload's
+// package
+func (api *DrafterAPI) fetchArtifacts(run *JobRun, dir, blueprintDir string, workload Workload) error {
+	run.Phase("download")
+
+	if err := api.config.Artifacts.checkDrafterVersion(); err != nil {
+		return err
 	}
 
+	drafteros := Workload{Name: artifactDrafterOS, Package: api.config.Artifacts.location(artifactDrafterOS)}
+	drafterosShare := 0.5
+	if !workload.isURL() {
+		drafterosShare = 1
+	}
+
+	// DrafterOS comes from the configured release, unless it is a file on
+	// this host already
+	drafterosPath := drafteros.Package
+	if drafteros.isURL() {
+		drafterosPath = filepath.Join(dir, "drafteros-oci.tar.zst")
+		if err := api.downloadAndVerifyFile(drafteros.Package, drafterosPath, downloadProgress(run, 0, drafterosShare, "drafteros")); err != nil {
+			log.Printf("Error downloading DrafterOS: %v", err)
+			return fmt.Errorf("failed to download DrafterOS: %v", err)
+		}
+	} else if err := checkLocalPackage(drafterosPath); err != nil {
+		return fmt.Errorf("DrafterOS: %v", err)
+	}
+
+	packagePath := workload.Package
+	if workload.isURL() {
+		packagePath = filepath.Join(dir, workload.fileName())
+		if err := api.downloadAndVerifyFile(workload.Package, packagePath, downloadProgress(run, 0.5, 0.5, workload.Name)); err != nil {
+			log.Printf("Error downloading %s package: %v", workload.Name, err)
+			return fmt.Errorf("failed to download %s package: %v", workload.Name, err)
+		}
+	}
+
+	run.Phase("extract")
+
 	// Extract DrafterOS blueprint
 	log.Printf("Extracting DrafterOS blueprint from %s", drafterosPath)
-	extractDevices := fmt.Sprintf(`[{"name":"kernel","path":"%s"},{"name":"disk","path":"%s"}]`,
-		filepath.Join(blueprintDir, "vmlinux"),
-		filepath.Join(blueprintDir, "rootfs.ext4"))
+	extractDevices, err := packagerDevicesJSON(blueprintDir, "kernel", "disk")
+	if err != nil {
+		return fmt.Errorf("invalid DrafterOS devices: %v", err)
+	}
 
-	extractCmd := exec.Command("sudo", "drafter-packager",
+	extractCmd := exec.Command("sudo", api.config.Artifacts.binary("drafter-packager"),
 		"--package-path", drafterosPath,
 		"--extract",
 		"--devices", extractDevices)
@@ -298,29 +643,30 @@ func (api *DrafterAPI) createVM(c *gin.Context) {
 	log.Printf("Running extraction command with devices: %s", extractDevices)
 	if out, err := runCommandWithOutput(extractCmd); err != nil {
 		log.Printf("Error extracting DrafterOS: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to extract DrafterOS: %v", err)})
-		return
+		return fmt.Errorf("failed to extract DrafterOS: %v", err)
 	} else {
 		log.Printf("DrafterOS extraction output: %s", out)
 	}
+	run.Progress(0.5, "extracted drafteros")
 
-	// Extract Valkey OCI
-	log.Printf("Extracting Valkey OCI from %s", valkeyPath)
-	extractValkeyDevices := fmt.Sprintf(`[{"name":"oci","path":"%s"}]`,
-		filepath.Join(blueprintDir, "oci.ext4"))
+	// Extract the workload's OCI package
+	log.Printf("Extracting %s OCI package from %s", workload.Name, packagePath)
+	extractOCIDevices, err := packagerDevicesJSON(blueprintDir, "oci")
+	if err != nil {
+		return fmt.Errorf("invalid OCI devices: %v", err)
+	}
 
-	log.Printf("Running Valkey extraction command with devices: %s", extractValkeyDevices)
-	extractValkeyCmd := exec.Command("sudo", "drafter-packager",
-		"--package-path", valkeyPath,
+	log.Printf("Running OCI extraction command with devices: %s", extractOCIDevices)
+	extractOCICmd := exec.Command("sudo", api.config.Artifacts.binary("drafter-packager"),
+		"--package-path", packagePath,
 		"--extract",
-		"--devices", extractValkeyDevices)
+		"--devices", extractOCIDevices)
 
-	if out, err := runCommandWithOutput(extractValkeyCmd); err != nil {
-		log.Printf("Error extracting Valkey OCI: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to extract Valkey OCI: %v", err)})
-		return
+	if out, err := runCommandWithOutput(extractOCICmd); err != nil {
+		log.Printf("Error extracting %s OCI package: %v", workload.Name, err)
+		return fmt.Errorf("failed to extract %s OCI package: %v", workload.Name, err)
 	} else {
-		log.Printf("Valkey OCI extraction output: %s", out)
+		log.Printf("%s OCI extraction output: %s", workload.Name, out)
 	}
 
 	// Verify extracted files
@@ -331,89 +677,60 @@ func (api *DrafterAPI) createVM(c *gin.Context) {
 	}
 
 	for _, file := range files {
-		if _, err := os.Stat(file); err != nil {
-			log.Printf("Error: extracted file %s not found: %v", file, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Extracted file %s missing", file)})
-			return
-		}
 		fileInfo, err := os.Stat(file)
-		if err == nil {
-			log.Printf("Extracted file %s size: %d bytes", file, fileInfo.Size())
+		if err != nil {
+			log.Printf("Error: extracted file %s not found: %v", file, err)
+			return fmt.Errorf("extracted file %s missing", file)
 		}
+		log.Printf("Extracted file %s size: %d bytes", file, fileInfo.Size())
 	}
+	return nil
+}
+
+var startPhases = []string{"network", "peer", "forwarder"}
 
-	// Start NAT service
-	natLogger.Printf("Starting NAT service")
-	natCmd := exec.Command("sudo", "drafter-nat", "--host-interface", "eth0")
-	natCmd.Stdout = logManager.logFiles["nat"]
-	natCmd.Stderr = logManager.logFiles["nat"]
-	if err := natCmd.Start(); err != nil {
-		natLogger.Printf("Error starting NAT service: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to start NAT service: %v", err)})
+func (api *DrafterAPI) startVM(c *gin.Context) {
+	name := c.Param("name")
+	log.Printf("Starting VM: %s", name)
+
+	if !api.checkNotBusy(c, name) {
 		return
 	}
-
-	log.Printf("Waiting 5 seconds for NAT to initialize")
-	time.Sleep(5 * time.Second)
-
-	// Start snapshotter
-	snapshotLogger.Printf("Starting snapshotter")
-	snapshotterCmd := exec.Command("sudo", "drafter-snapshotter",
-		"--netns", "ark0",
-		"--cpu-template", "T2A",
-		"--memory-size", config.Memory,
-		"--devices", fmt.Sprintf(`[
-        {
-            "name": "state",
-            "output": "/home/ec2-user/out/package/state.bin"
-        },
-        {
-            "name": "memory",
-            "output": "/home/ec2-user/out/package/memory.bin"
-        },
-        {
-            "name": "kernel",
-            "input": "/home/ec2-user/out/blueprint/vmlinux",
-            "output": "/home/ec2-user/out/package/vmlinux"
-        },
-        {
-            "name": "disk",
-            "input": "/home/ec2-user/out/blueprint/rootfs.ext4",
-            "output": "/home/ec2-user/out/package/rootfs.ext4"
-        },
-        {
-            "name": "config",
-            "output": "/home/ec2-user/out/package/config.json"
-        },
-        {
-            "name": "oci",
-            "input": "/home/ec2-user/out/blueprint/oci.ext4",
-            "output": "/home/ec2-user/out/package/oci.ext4"
-        }
-    ]`))
-	println(snapshotterCmd.String())
-	snapshotterCmd.Stdout = logManager.logFiles["snapshotter"]
-	snapshotterCmd.Stderr = logManager.logFiles["snapshotter"]
-	if err := snapshotterCmd.Start(); err != nil {
-		snapshotLogger.Printf("Error starting snapshotter: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to start snapshotter: %v", err)})
+	var previous VMRecord
+	if _, err := api.registry.Update(name, func(rec *VMRecord) error {
+		previous = *rec
+		return rec.transition(PhaseStarting, nil)
+	}); err != nil {
+		writeTransitionError(c, name, err)
 		return
 	}
 
-	log.Printf("VM creation initiated successfully: %s", config.Name)
-	c.JSON(http.StatusOK, gin.H{"message": "VM creation initiated", "name": config.Name})
+	if _, ok := api.submitJob(c, "start", name, startPhases, func(run *JobRun) (gin.H, error) {
+		return api.runStart(run, name)
+	}); !ok {
+		api.restoreVM(name, PhaseStarting, &previous)
+	}
 }
 
-func (api *DrafterAPI) startVM(c *gin.Context) {
-	name := c.Param("name")
-	log.Printf("Starting VM: %s", name)
+func (api *DrafterAPI) runStart(run *JobRun, name string) (result gin.H, err error) {
+	defer func() {
+		if err != nil {
+			api.abortStart(name, err)
+		}
+	}()
+
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	run.Phase("network")
 
 	// Setup logging
 	logManager, err := api.setupLogging(name)
 	if err != nil {
 		log.Printf("Error setting up logging: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to setup logging: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to setup logging: %v", err)
 	}
 	defer logManager.Close()
 
@@ -421,198 +738,419 @@ func (api *DrafterAPI) startVM(c *gin.Context) {
 	peerLogger, err := logManager.GetLogger("peer")
 	if err != nil {
 		log.Printf("Error creating peer logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create peer logger: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to create peer logger: %v", err)
 	}
 
-	peerLogger.Printf("Starting peer service")
-	peerCmd := exec.Command("sudo", "drafter-peer",
-		"--netns", "ark0",
-		"--raddr", "",
-		"--laddr", ":1337",
-		"--devices", fmt.Sprintf(`[
-			{
-					"name": "state",
-					"base": "/home/ec2-user/out/package/state.bin",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/state.bin",
-					"state": "/home/ec2-user/out/instance-0/state/state.bin",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "memory",
-					"base": "/home/ec2-user/out/package/memory.bin",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/memory.bin",
-					"state": "/home/ec2-user/out/instance-0/state/memory.bin",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "kernel",
-					"base": "/home/ec2-user/out/package/vmlinux",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/vmlinux",
-					"state": "/home/ec2-user/out/instance-0/state/vmlinux",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "disk",
-					"base": "/home/ec2-user/out/package/rootfs.ext4",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/rootfs.ext4",
-					"state": "/home/ec2-user/out/instance-0/state/rootfs.ext4",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "config",
-					"base": "/home/ec2-user/out/package/config.json",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/config.json",
-					"state": "/home/ec2-user/out/instance-0/state/config.json",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "oci",
-					"base": "/home/ec2-user/out/package/oci.ext4",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/oci.ext4",
-					"state": "/home/ec2-user/out/instance-0/state/oci.ext4",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			}
-	]`))
+	netns, err := api.netns.Acquire(name)
+	if err != nil {
+		peerLogger.Printf("Error allocating netns: %v", err)
+		return nil, fmt.Errorf("failed to allocate network namespace: %v", err)
+	}
+
+	peerPort, err := api.acquirePeerPort(name)
+	if err != nil {
+		peerLogger.Printf("Error allocating peer port: %v", err)
+		return nil, fmt.Errorf("failed to allocate peer port: %v", err)
+	}
 
-	println(peerCmd.String())
-	peerCmd.Stdout = logManager.logFiles["peer"]
-	peerCmd.Stderr = logManager.logFiles["peer"]
+	forwardPort, err := api.acquireForwardPort(name)
+	if err != nil {
+		peerLogger.Printf("Error allocating forward port: %v", err)
+		return nil, fmt.Errorf("failed to allocate forward port: %v", err)
+	}
+	forwardAddr := net.JoinHostPort(api.config.ForwardHost, strconv.Itoa(forwardPort))
 
-	if err := peerCmd.Start(); err != nil {
+	devices, err := peerDevicesJSON(record)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer devices: %v", err)
+	}
+	forwards, err := portForwardsJSON(netns, record.Config.workload(api.config.Artifacts.defaultWorkload()).portString(), forwardAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Phase("peer")
+	peerLogger.Printf("Starting peer service in netns %s on port %d", netns, peerPort)
+	peer, err := api.startProcess(name, "peer", logManager,
+		"sudo", api.config.Artifacts.binary("drafter-peer"),
+		"--netns", netns,
+		"--raddr", "",
+		"--laddr", fmt.Sprintf(":%d", peerPort),
+		"--devices", devices)
+	if err != nil {
 		peerLogger.Printf("Error starting peer service: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start peer service"})
-		return
+		return nil, fmt.Errorf("failed to start peer service: %v", err)
+	}
+
+	run.Progress(0.5, fmt.Sprintf("waiting up to %s for the peer to resume the VM", api.config.PeerReadyTimeout))
+	if err := api.peerReady(name, logManager, peerPort); err != nil {
+		peerLogger.Printf("Peer service not ready: %v", err)
+		return nil, err
 	}
+	peerLogger.Printf("Peer service ready")
 
-	peerLogger.Printf("Waiting 5 seconds for peer to initialize")
-	time.Sleep(5 * time.Second)
+	run.Phase("forwarder")
 
 	// Start forwarder
 	forwarderLogger, err := logManager.GetLogger("forwarder")
 	if err != nil {
 		log.Printf("Error creating forwarder logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create forwarder logger: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to create forwarder logger: %v", err)
 	}
 
 	forwarderLogger.Printf("Starting forwarder")
-	forwarderCmd := exec.Command("drafter-forwarder", "--port-forwards", fmt.Sprintf(`[{"netns":"ark0","internalPort":"6379","protocol":"tcp","externalAddr":"127.0.0.1:3333"}]`))
-
-	forwarderCmd.Stdout = logManager.logFiles["forwarder"]
-	forwarderCmd.Stderr = logManager.logFiles["forwarder"]
-
-	if err := forwarderCmd.Start(); err != nil {
+	forwarder, err := api.startProcess(name, "forwarder", logManager,
+		"sudo", api.config.Artifacts.binary("drafter-forwarder"), "--port-forwards", forwards)
+	if err != nil {
 		forwarderLogger.Printf("Error starting forwarder: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start forwarder"})
-		return
+		return nil, fmt.Errorf("failed to start forwarder: %v", err)
+	}
+	if err := api.forwarderReady(name, forwardAddr); err != nil {
+		forwarderLogger.Printf("Forwarder not ready: %v", err)
+		return nil, err
+	}
+
+	record, err = api.registry.Transition(record.Name, PhaseRunning, nil, func(rec *VMRecord) error {
+		rec.LogsPath = logManager.baseDir
+		if rec.PIDs == nil {
+			rec.PIDs = make(map[string]int)
+		}
+		rec.PIDs["peer"] = peer.PID
+		rec.PIDs["forwarder"] = forwarder.PID
+		return nil
+	})
+	if err != nil {
+		forwarderLogger.Printf("Error updating VM record: %v", err)
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
 	}
 
+	go api.watchMigrations(name)
+
 	forwarderLogger.Printf("VM started successfully: %s", name)
-	c.JSON(http.StatusOK, gin.H{
+	return gin.H{
 		"message":   "VM started",
 		"name":      name,
+		"netns":     netns,
+		"endpoints": api.endpoints(record),
 		"logs_path": logManager.baseDir,
-	})
+	}, nil
 }
 
+var stopPhases = []string{"stop", "release"}
+
 func (api *DrafterAPI) stopVM(c *gin.Context) {
 	name := c.Param("name")
 	log.Printf("Stopping VM: %s", name)
 
-	// Stop all drafter services for this VM
-	cmd := exec.Command("pkill", "-f", fmt.Sprintf("ark-%s", name))
-	if out, err := runCommandWithOutput(cmd); err != nil {
-		log.Printf("Error stopping services: %v", err)
-	} else {
-		log.Printf("Services stopped: %s", out)
+	record, ok := api.lookupVM(c, name)
+	if !ok || !checkTransition(c, record, PhaseStopped) {
+		return
+	}
+
+	grace, err := api.stopGracePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	api.submitJob(c, "stop", name, stopPhases, func(run *JobRun) (gin.H, error) {
+		return api.runStop(run, name, grace)
+	})
+}
+
+func (api *DrafterAPI) runStop(run *JobRun, name string, grace time.Duration) (gin.H, error) {
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	// Stop the VM's own tracked processes
+	run.Phase("stop")
+	results, err := api.stopVMProcesses(record, grace)
+	if err != nil {
+		log.Printf("Error stopping VM %s: %v", name, err)
+		api.failVM(name, err)
+		return gin.H{"name": name, "components": results}, err
+	}
+
+	run.Phase("release")
+	if _, err := api.registry.Transition(name, PhaseStopped, nil, func(rec *VMRecord) error {
+		for _, component := range stopOrder {
+			delete(rec.PIDs, component)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Error updating VM record: %v", err)
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
+	}
+
+	if err := api.netns.Release(name); err != nil {
+		log.Printf("Error releasing netns: %v", err)
+	}
+	if err := api.ports.Release(name); err != nil {
+		log.Printf("Error releasing ports: %v", err)
 	}
 
 	log.Printf("VM stopped successfully: %s", name)
-	c.JSON(http.StatusOK, gin.H{"message": "VM stopped", "name": name})
+	return gin.H{
+		"message":      "VM stopped",
+		"name":         name,
+		"grace_period": grace.String(),
+		"components":   results,
+	}, nil
+}
+
+// stopGracePeriod reads the force and grace_period query parameters
+func (api *DrafterAPI) stopGracePeriod(c *gin.Context) (time.Duration, error) {
+	if force := c.Query("force"); force != "" {
+		forced, err := strconv.ParseBool(force)
+		if err != nil {
+			return 0, fmt.Errorf("invalid force value %q", force)
+		}
+		if forced {
+			return 0, nil
+		}
+	}
+
+	grace := api.config.StopGracePeriod
+	if value := c.Query("grace_period"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("invalid grace_period %q, expected a duration such as 10s", value)
+		}
+		grace = parsed
+	}
+	return grace, nil
 }
 
 func (api *DrafterAPI) getVMStatus(c *gin.Context) {
 	name := c.Param("name")
 	log.Printf("Getting status for VM: %s", name)
 
-	// Check if services are running
-	natRunning := exec.Command("pgrep", "-f", "drafter-nat").Run() == nil
-	peerRunning := exec.Command("pgrep", "-f", fmt.Sprintf("ark-%s.*drafter-peer", name)).Run() == nil
-	forwarderRunning := exec.Command("pgrep", "-f", fmt.Sprintf("ark-%s.*drafter-forwarder", name)).Run() == nil
+	record, ok := api.lookupVM(c, name)
+	if !ok {
+		return
+	}
+
+	// Prefer the supervisor's view and fall back to the recorded PIDs for
+	// processes it does not own
+	services := gin.H{}
+	for component, pid := range record.PIDs {
+		services[component] = processAlive(pid)
+	}
+	processes := api.supervisor.List(name)
+	for _, process := range processes {
+		services[process.Component] = process.Running
+	}
+	if nat, ok := api.supervisor.Status("", "nat"); ok {
+		services["nat"] = nat.Running
+		processes = append(processes, nat)
+	}
+
+	deviceTuning, err := record.Config.Tuning.Resolve()
+	if err != nil {
+		log.Printf("Error resolving tuning of VM %s: %v", name, err)
+	}
 
 	status := gin.H{
-		"name": name,
-		"services": gin.H{
-			"nat":       natRunning,
-			"peer":      peerRunning,
-			"forwarder": forwarderRunning,
-		},
+		"name":           record.Name,
+		"phase":          record.Phase,
+		"error":          record.Error,
+		"memory":         record.Config.Memory,
+		"source":         record.Source,
+		"blueprint":      record.Config.Blueprint,
+		"workload":       record.Config.workload(api.config.Artifacts.defaultWorkload()),
+		"cpu_template":   record.Config.cpuTemplate(),
+		"labels":         record.Config.Labels,
+		"netns":          record.Netns,
+		"ports":          record.Ports,
+		"endpoints":      api.endpoints(record),
+		"pids":           record.PIDs,
+		"logs_path":      record.LogsPath,
+		"created_at":     record.CreatedAt,
+		"updated_at":     record.UpdatedAt,
+		"package_config": record.PackageConfig,
+		"tuning":         record.Config.Tuning,
+		"device_tuning":  deviceTuning,
+		"transitions":    record.Transitions,
+		"services":       services,
+		"processes":      processes,
 	}
 
 	log.Printf("Status for VM %s: %v", name, status)
 	c.JSON(http.StatusOK, status)
 }
 
+var migratePhases = []string{"prepare", "network", "peer", "forwarder"}
+
+// migrationSource is the API of the host a VM is migrated from. It is asked
+// about the VM at most once.
+type migrationSource struct {
+	api    string
+	name   string
+	status *sourceVMStatus
+}
+
+// sourceVMStatus is the part of the source's GET /vm/status a migration reads
+type sourceVMStatus struct {
+	CPUTemplate string         `json:"cpu_template"`
+	Ports       map[string]int `json:"ports"`
+}
+
+func (s *migrationSource) Status() (*sourceVMStatus, error) {
+	if s.status != nil {
+		return s.status, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimRight(s.api, "/") + "/vm/status/" + url.PathEscape(s.name))
+	if err != nil {
+		return nil, fmt.Errorf("asking %s: %v", s.api, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("asking %s: bad HTTP response: %s", s.api, resp.Status)
+	}
+
+	var status sourceVMStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("asking %s: invalid VM status: %v", s.api, err)
+	}
+	s.status = &status
+	return s.status, nil
+}
+
+// PeerPort is the port the source allocated to the VM's drafter-peer
+func (s *migrationSource) PeerPort() (int, error) {
+	status, err := s.Status()
+	if err != nil {
+		return 0, err
+	}
+	port := status.Ports[PortPeer]
+	if port == 0 {
+		return 0, fmt.Errorf("%s reports no peer port for %s, is it running there?", s.api, s.name)
+	}
+	return port, nil
+}
+
 func (api *DrafterAPI) migrateVM(c *gin.Context) {
 	name := c.Param("name")
+	if err := validateVMName(name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	var config struct {
-		SourceIP string `json:"source_ip"`
+		SourceIP   string           `json:"source_ip"`
+		SourcePort int              `json:"source_port"`
+		Tuning     *MigrationTuning `json:"tuning"`
+		Workload   *Workload        `json:"workload"`
+		// CPUTemplate is the source's, which this host has to support. The
+		// source's API at SourceAPI is asked for it when it is not given.
+		CPUTemplate string `json:"cpu_template"`
+		SourceAPI   string `json:"source_api"`
 	}
 	if err := c.BindJSON(&config); err != nil {
 		log.Printf("Error parsing migration request: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if config.SourceIP == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "source_ip is required"})
+		return
+	}
+	if _, err := config.Tuning.Resolve(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The package comes from the source, but the forwarder needs the port
+	if config.Workload != nil {
+		if config.Workload.Port == 0 {
+			config.Workload.Port = defaultWorkloadPort
+		}
+		if config.Workload.Port < 1 || config.Workload.Port > 65535 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("workload.port must be between 1 and 65535, got %d", config.Workload.Port)})
+			return
+		}
+	}
+	if !api.checkNotBusy(c, name) {
+		return
+	}
+
+	// What the request leaves out is asked of the source's API
+	if config.SourceAPI == "" {
+		config.SourceAPI = "http://" + net.JoinHostPort(config.SourceIP, api.config.listenPort())
+	}
+	source := &migrationSource{api: config.SourceAPI, name: name}
+	if config.SourcePort == 0 {
+		port, err := source.PeerPort()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot tell the peer port of %s, pass source_port: %v", name, err)})
+			return
+		}
+		config.SourcePort = port
+	}
+	sourceAddr := net.JoinHostPort(config.SourceIP, strconv.Itoa(config.SourcePort))
+
+	// The VM usually has no record on the destination host yet
+	record, err := api.registry.Get(name)
+	if errors.Is(err, ErrVMNotFound) {
+		record = &VMRecord{Name: name, Config: VMConfig{Name: name}}
+	} else if err != nil {
+		log.Printf("Error reading VM record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read VM record: %v", err)})
+		return
+	}
+	// A VM keeps its stored tuning unless the request brings its own
+	if config.Tuning != nil {
+		record.Config.Tuning = config.Tuning
+	}
+	if config.Workload != nil {
+		record.Config.Workload = config.Workload
+	}
+	api.config.setVMPaths(record)
+	// Refuse a VM this host's CPU cannot resume before pulling any of it
+	template, err := migrationCPUTemplate(record, config.CPUTemplate, source)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot tell the CPU template of %s, pass cpu_template: %v", name, err)})
+		return
+	}
+	if err := hostCPU().supports(template); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("cannot migrate %s to this host: %v", name, err)})
+		return
+	}
+	record.Config.CPUTemplate = template
+	previous, err := api.registry.Replace(record, PhaseMigratingIn)
+	if err != nil {
+		writeTransitionError(c, name, err)
+		return
+	}
+
+	if _, ok := api.submitJob(c, "migrate", name, migratePhases, func(run *JobRun) (gin.H, error) {
+		return api.runMigrate(run, name, sourceAddr)
+	}); !ok {
+		api.restoreVM(name, PhaseMigratingIn, previous)
+	}
+}
+
+func (api *DrafterAPI) runMigrate(run *JobRun, name, sourceAddr string) (result gin.H, err error) {
+	defer func() {
+		if err != nil {
+			api.abortStart(name, err)
+		}
+	}()
+
+	record, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	run.Phase("prepare")
 
 	// Setup logging
 	logManager, err := api.setupLogging(name)
 	if err != nil {
 		log.Printf("Error setting up logging: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to setup logging: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to setup logging: %v", err)
 	}
 	defer logManager.Close()
 
@@ -620,162 +1158,140 @@ func (api *DrafterAPI) migrateVM(c *gin.Context) {
 	peerLogger, err := logManager.GetLogger("peer")
 	if err != nil {
 		log.Printf("Error creating peer logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create peer logger: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to create peer logger: %v", err)
 	}
 
-	peerLogger.Printf("Starting migration for VM %s from source IP %s", name, config.SourceIP)
+	peerLogger.Printf("Starting migration for VM %s from %s", name, sourceAddr)
 
 	// Create instance directory
-	cmd := exec.Command("sudo", "mkdir", "-p",
-		"/home/ec2-user/out/instance-0/overlay",
-		"/home/ec2-user/out/instance-0/state")
+	cmd := exec.Command("sudo", "mkdir", "-p", record.OverlayDir, record.StateDir)
 	if out, err := runCommandWithOutput(cmd); err != nil {
 		peerLogger.Printf("Error creating instance directories: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create instance directories: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to create instance directories: %v", err)
 	} else {
 		peerLogger.Printf("Created instance directories: %s", out)
 	}
 
-	// Start peer service for migration
-	peerLogger.Printf("Starting peer service for migration")
-	peerCmd := exec.Command("sudo", "drafter-peer", "--netns", "ark0", "--raddr", fmt.Sprintf("%s:1337", config.SourceIP), "--laddr", "", "--devices", `[
-			{
-					"name": "state",
-					"base": "/home/ec2-user/out/package/state.bin",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/state.bin",
-					"state": "/home/ec2-user/out/instance-0/state/state.bin",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "memory",
-					"base": "/home/ec2-user/out/package/memory.bin",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/memory.bin",
-					"state": "/home/ec2-user/out/instance-0/state/memory.bin",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "kernel",
-					"base": "/home/ec2-user/out/package/vmlinux",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/vmlinux",
-					"state": "/home/ec2-user/out/instance-0/state/vmlinux",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "disk",
-					"base": "/home/ec2-user/out/package/rootfs.ext4",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/rootfs.ext4",
-					"state": "/home/ec2-user/out/instance-0/state/rootfs.ext4",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "config",
-					"base": "/home/ec2-user/out/package/config.json",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/config.json",
-					"state": "/home/ec2-user/out/instance-0/state/config.json",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			},
-			{
-					"name": "oci",
-					"base": "/home/ec2-user/out/package/oci.ext4",
-					"overlay": "/home/ec2-user/out/instance-0/overlay/oci.ext4",
-					"state": "/home/ec2-user/out/instance-0/state/oci.ext4",
-					"blockSize": 65536,
-					"expiry": 1000000000,
-					"maxDirtyBlocks": 200,
-					"minCycles": 5,
-					"maxCycles": 20,
-					"cycleThrottle": 500000000,
-					"makeMigratable": true,
-					"shared": false
-			}
-	]`)
+	run.Phase("network")
+	netns, err := api.netns.Acquire(name)
+	if err != nil {
+		peerLogger.Printf("Error allocating netns: %v", err)
+		return nil, fmt.Errorf("failed to allocate network namespace: %v", err)
+	}
+
+	forwardPort, err := api.acquireForwardPort(name)
+	if err != nil {
+		peerLogger.Printf("Error allocating forward port: %v", err)
+		return nil, fmt.Errorf("failed to allocate forward port: %v", err)
+	}
+	forwardAddr := net.JoinHostPort(api.config.ForwardHost, strconv.Itoa(forwardPort))
 
-	// Set up logging before starting the command
-	peerCmd.Stdout = logManager.logFiles["peer"]
-	peerCmd.Stderr = logManager.logFiles["peer"]
+	devices, err := peerDevicesJSON(record)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer devices: %v", err)
+	}
+	forwards, err := portForwardsJSON(netns, record.Config.workload(api.config.Artifacts.defaultWorkload()).portString(), forwardAddr)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := peerCmd.Start(); err != nil {
+	// Start peer service for migration
+	run.Phase("peer")
+	peerLogger.Printf("Starting peer service for migration")
+	peer, err := api.startProcess(name, "peer", logManager,
+		"sudo", api.config.Artifacts.binary("drafter-peer"), "--netns", netns, "--raddr", sourceAddr, "--laddr", "", "--devices", devices)
+	if err != nil {
 		peerLogger.Printf("Error starting peer service: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start peer service"})
-		return
+		return nil, fmt.Errorf("failed to start peer service: %v", err)
+	}
+
+	// The peer resumes the VM once it has pulled it from the source
+	run.Progress(0.5, fmt.Sprintf("waiting up to %s for the migration to finish", api.config.PeerReadyTimeout))
+	if err := api.peerReady(name, logManager, 0); err != nil {
+		peerLogger.Printf("Peer service not ready: %v", err)
+		return nil, err
 	}
+	peerLogger.Printf("Peer service ready")
 
-	peerLogger.Printf("Waiting 5 seconds for peer to initialize")
-	time.Sleep(5 * time.Second)
+	run.Phase("forwarder")
 
 	// Set up forwarder logging
 	forwarderLogger, err := logManager.GetLogger("forwarder")
 	if err != nil {
 		log.Printf("Error creating forwarder logger: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create forwarder logger: %v", err)})
-		return
+		return nil, fmt.Errorf("failed to create forwarder logger: %v", err)
 	}
 
 	// Start forwarder
 	forwarderLogger.Printf("Starting forwarder")
-	forwarderCmd := exec.Command("sudo", "drafter-forwarder", "--port-forwards",
-		`[{"netns":"ark0","internalPort":"6379","protocol":"tcp","externalAddr":"127.0.0.1:3334"}]`)
+	forwarder, err := api.startProcess(name, "forwarder", logManager,
+		"sudo", api.config.Artifacts.binary("drafter-forwarder"), "--port-forwards", forwards)
+	if err != nil {
+		forwarderLogger.Printf("Error starting forwarder: %v", err)
+		return nil, fmt.Errorf("failed to start forwarder: %v", err)
+	}
+	if err := api.forwarderReady(name, forwardAddr); err != nil {
+		forwarderLogger.Printf("Forwarder not ready: %v", err)
+		return nil, err
+	}
 
-	// Set up logging before starting the command
-	forwarderCmd.Stdout = logManager.logFiles["forwarder"]
-	forwarderCmd.Stderr = logManager.logFiles["forwarder"]
+	record, err = api.registry.Transition(name, PhaseRunning, nil, func(rec *VMRecord) error {
+		rec.LogsPath = logManager.baseDir
+		rec.PIDs = map[string]int{
+			"peer":      peer.PID,
+			"forwarder": forwarder.PID,
+		}
+		return nil
+	})
+	if err != nil {
+		forwarderLogger.Printf("Error updating VM record: %v", err)
+		return nil, fmt.Errorf("failed to update VM record: %v", err)
+	}
 
-	if err := forwarderCmd.Start(); err != nil {
-		forwarderLogger.Printf("Error starting forwarder: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start forwarder"})
-		return
+	go api.watchMigrations(name)
+
+	// The package now lives here, so a later migration can read its template
+	if err := writePackageCPUTemplate(record.PackageDir, record.Config.cpuTemplate()); err != nil {
+		log.Printf("Error recording CPU template of VM %s: %v", name, err)
 	}
 
 	forwarderLogger.Printf("Migration initiated for VM: %s", name)
-	c.JSON(http.StatusOK, gin.H{
+	return gin.H{
 		"message":   "Migration initiated",
 		"name":      name,
-		"source":    config.SourceIP,
-		"status":    "migrating",
+		"source":    sourceAddr,
+		"phase":     record.Phase,
+		"netns":     netns,
+		"endpoints": api.endpoints(record),
 		"logs_path": logManager.baseDir,
-	})
+	}, nil
 }
+
 func main() {
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := config.checkHost(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	log.Printf("Starting Drafter API server")
-	api := NewDrafterAPI()
-	if err := api.router.Run(":8080"); err != nil {
+	registry, err := OpenRegistry(config.RegistryPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer registry.Close()
+
+	if err := registry.FailInterruptedJobs(config.JobRetention); err != nil {
+		log.Fatal(err)
+	}
+
+	api := NewDrafterAPI(config, registry)
+	if err := api.reconcile(); err != nil {
+		log.Fatal(err)
+	}
+	if err := api.router.Run(config.ListenAddr); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMigrationSource(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/vm/status/vm-1":
+			fmt.Fprint(w, `{"name": "vm-1", "phase": "running", "cpu_template": "T2", "ports": {"peer": 1342, "forward": 3335}}`)
+		case "/vm/status/stopped":
+			fmt.Fprint(w, `{"name": "stopped", "phase": "stopped"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source := &migrationSource{api: server.URL + "/", name: "vm-1"}
+	port, err := source.PeerPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 1342 {
+		t.Errorf("PeerPort() = %d, want the source's allocated 1342", port)
+	}
+	status, err := source.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.CPUTemplate != "T2" {
+		t.Errorf("CPUTemplate = %q, want T2", status.CPUTemplate)
+	}
+	if requests != 1 {
+		t.Errorf("the source was asked %d times, want once", requests)
+	}
+
+	if _, err := (&migrationSource{api: server.URL, name: "stopped"}).PeerPort(); err == nil {
+		t.Error("PeerPort() of a VM without a peer port succeeded")
+	}
+	if _, err := (&migrationSource{api: server.URL, name: "missing"}).PeerPort(); err == nil {
+		t.Error("PeerPort() of a VM the source does not know succeeded")
+	}
+}
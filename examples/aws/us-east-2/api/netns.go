@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const netnsRunDir = "/var/run/netns"
+
+var ErrNoFreeNetns = errors.New("no free network namespace")
+
+// NetnsAllocator hands out the arkN namespaces created by drafter-nat. The
+// registry is the source of truth for which VM holds which namespace.
+type NetnsAllocator struct {
+	registry *Registry
+	prefix   string
+	poolSize int
+	// runDir is where ip netns keeps the named namespaces
+	runDir string
+}
+
+func NewNetnsAllocator(registry *Registry, prefix string, poolSize int) *NetnsAllocator {
+	return &NetnsAllocator{
+		registry: registry,
+		prefix:   prefix,
+		poolSize: poolSize,
+		runDir:   netnsRunDir,
+	}
+}
+
+func (a *NetnsAllocator) name(i int) string {
+	return fmt.Sprintf("%s%d", a.prefix, i)
+}
+
+func (a *NetnsAllocator) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(a.runDir, name))
+	return err == nil
+}
+
+// PoolReady reports whether drafter-nat has created at least one namespace
+func (a *NetnsAllocator) PoolReady() bool {
+	return a.exists(a.name(0))
+}
+
+// pick returns a free namespace. Namespaces held by VMs and by blueprint
+// builds are both in use.
+func (a *NetnsAllocator) pick(tx *bolt.Tx) (string, error) {
+	used := make(map[string]bool)
+	for _, bucket := range [][]byte{vmsBucket, blueprintsBucket} {
+		if err := tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var holder struct {
+				Netns string `json:"netns"`
+			}
+			if err := json.Unmarshal(v, &holder); err != nil {
+				return fmt.Errorf("failed to decode record for %s: %v", k, err)
+			}
+			if holder.Netns != "" {
+				used[holder.Netns] = true
+			}
+			return nil
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	for i := 0; i < a.poolSize; i++ {
+		candidate := a.name(i)
+		if !used[candidate] && a.exists(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: all %d namespaces with prefix %q are in use or missing", ErrNoFreeNetns, a.poolSize, a.prefix)
+}
+
+// Acquire assigns a free namespace to the VM, or returns the one it already holds
+func (a *NetnsAllocator) Acquire(vmName string) (string, error) {
+	var netns string
+	err := a.registry.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+		rec, err := getRecord(b, vmName)
+		if err != nil {
+			return err
+		}
+		if rec.Netns == "" {
+			if rec.Netns, err = a.pick(tx); err != nil {
+				return err
+			}
+			rec.UpdatedAt = time.Now().UTC()
+			if err := putRecord(b, rec); err != nil {
+				return err
+			}
+		}
+		netns = rec.Netns
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Assigned netns %s to VM %s", netns, vmName)
+	return netns, nil
+}
+
+// Release returns the VM's namespace to the pool
+func (a *NetnsAllocator) Release(vmName string) error {
+	_, err := a.registry.Update(vmName, func(rec *VMRecord) error {
+		if rec.Netns != "" {
+			log.Printf("Released netns %s from VM %s", rec.Netns, vmName)
+		}
+		rec.Netns = ""
+		return nil
+	})
+	return err
+}
+
+// ensureNAT starts drafter-nat as a host-wide supervised process unless it
+// is already running or its namespace pool already exists
+func (api *DrafterAPI) ensureNAT(logManager *LogManager) error {
+	api.natMu.Lock()
+	defer api.natMu.Unlock()
+
+	// Another job may have just started it, so wait for it to be ready too
+	if status, ok := api.supervisor.Status("", "nat"); ok && status.Running {
+		return api.waitReady("", "nat", api.config.NATReadyTimeout, api.netns.natReady)
+	}
+	if api.netns.PoolReady() {
+		log.Printf("NAT namespaces already present, not starting drafter-nat")
+		return nil
+	}
+
+	natLogger, err := logManager.GetLogger("nat")
+	if err != nil {
+		return fmt.Errorf("failed to create NAT logger: %v", err)
+	}
+
+	natLogger.Printf("Starting NAT service")
+	if _, err := api.startProcess("", "nat", logManager,
+		"sudo", api.config.Artifacts.binary("drafter-nat"),
+		"--host-interface", api.config.HostInterface,
+		"--namespace-prefix", api.config.NetnsPrefix); err != nil {
+		natLogger.Printf("Error starting NAT service: %v", err)
+		return fmt.Errorf("failed to start NAT service: %v", err)
+	}
+
+	log.Printf("Waiting up to %s for NAT to initialize", api.config.NATReadyTimeout)
+	if err := api.waitReady("", "nat", api.config.NATReadyTimeout, api.netns.natReady); err != nil {
+		natLogger.Printf("NAT service not ready: %v", err)
+		return err
+	}
+	natLogger.Printf("NAT service ready")
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetnsAllocator(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	a := NewNetnsAllocator(reg, "ark", 3)
+	a.runDir = t.TempDir()
+	if a.PoolReady() {
+		t.Error("PoolReady() = true before drafter-nat created any namespace")
+	}
+	// drafter-nat has not created ark1
+	for _, name := range []string{"ark0", "ark2"} {
+		if err := os.WriteFile(filepath.Join(a.runDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !a.PoolReady() {
+		t.Error("PoolReady() = false with ark0 present")
+	}
+	for _, name := range []string{"vm-1", "vm-2", "vm-3"} {
+		if err := reg.Put(&VMRecord{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acquire := func(vm, want string) {
+		t.Helper()
+		netns, err := a.Acquire(vm)
+		if err != nil {
+			t.Fatalf("Acquire(%s) = %v", vm, err)
+		}
+		if netns != want {
+			t.Errorf("Acquire(%s) = %s, want %s", vm, netns, want)
+		}
+	}
+	acquire("vm-1", "ark0")
+	// A VM keeps the namespace it holds
+	acquire("vm-1", "ark0")
+	acquire("vm-2", "ark2")
+	if _, err := a.Acquire("vm-3"); !errors.Is(err, ErrNoFreeNetns) {
+		t.Errorf("Acquire() from an exhausted pool = %v, want ErrNoFreeNetns", err)
+	}
+
+	if err := a.Release("vm-1"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := reg.Get("vm-1"); rec.Netns != "" {
+		t.Errorf("released VM still holds %s", rec.Netns)
+	}
+	acquire("vm-3", "ark0")
+
+	if _, err := a.Acquire("unknown"); !errors.Is(err, ErrVMNotFound) {
+		t.Errorf("Acquire() for an unknown VM = %v, want ErrVMNotFound", err)
+	}
+}
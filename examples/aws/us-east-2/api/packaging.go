@@ -0,0 +1,712 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	WorkloadBuilding = "building"
+	WorkloadReady    = "ready"
+	WorkloadFailed   = "failed"
+)
+
+// Workloads built here live next to the VM trees, like blueprints
+const workloadsKey = "_workloads"
+
+var (
+	workloadsBucket = []byte("workloads")
+
+	ErrWorkloadNotFound = errors.New("workload not found")
+	ErrWorkloadExists   = errors.New("workload already exists")
+	ErrWorkloadInUse    = errors.New("workload is in use")
+)
+
+var packagePhases = []string{"fetch", "ext4", "package", "register"}
+
+// The ext4 image gets this much room on top of the image layout, which the
+// guest unpacks in place
+const (
+	ext4Headroom = 64 << 20
+	ext4Slack    = 2
+)
+
+// WorkloadRecord is a workload whose package was built from a container image
+type WorkloadRecord struct {
+	Workload
+
+	Phase string `json:"phase"`
+	Error string `json:"error,omitempty"`
+
+	// Image is the image reference, or Layout the OCI layout tarball, it
+	// was built from
+	Image    string `json:"image,omitempty"`
+	Layout   string `json:"layout,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+	Size     string `json:"size,omitempty"`
+
+	Dir  string `json:"dir"`
+	Ext4 int64  `json:"ext4_bytes,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// workloadRequest is the body of POST /workloads
+type workloadRequest struct {
+	Name string `json:"name"`
+	// Image is a reference such as localhost:5000/app:latest or any
+	// skopeo source like docker://...; Layout is an OCI image layout tarball
+	// on this host. Exactly one is needed.
+	Image    string `json:"image"`
+	Layout   string `json:"layout"`
+	Insecure bool   `json:"insecure"`
+	Port     int    `json:"port"`
+	Size     string `json:"size"`
+}
+
+// workloadOwner is the name a workload's jobs run under
+func workloadOwner(name string) string {
+	return workloadsKey + "/" + name
+}
+
+func getWorkload(b *bolt.Bucket, name string) (*WorkloadRecord, error) {
+	data := b.Get([]byte(name))
+	if data == nil {
+		return nil, ErrWorkloadNotFound
+	}
+
+	var rec WorkloadRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode workload %s: %v", name, err)
+	}
+	return &rec, nil
+}
+
+func putWorkload(b *bolt.Bucket, rec *WorkloadRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode workload %s: %v", rec.Name, err)
+	}
+	return b.Put([]byte(rec.Name), data)
+}
+
+func (r *Registry) GetWorkload(name string) (*WorkloadRecord, error) {
+	var rec *WorkloadRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = getWorkload(tx.Bucket(workloadsBucket), name)
+		return err
+	})
+	return rec, err
+}
+
+// WorkloadUsers are the VMs and blueprints whose package is a workload's
+type WorkloadUsers struct {
+	VMs        []string `json:"vms"`
+	Blueprints []string `json:"blueprints"`
+}
+
+// usesPackageIn reports whether a spec's workload package lives in dir
+func usesPackageIn(spec PackageSpec, dir string) bool {
+	return spec.Workload != nil && strings.HasPrefix(spec.Workload.Package, dir+string(filepath.Separator))
+}
+
+// workloadUsers finds the VMs that still exist and the blueprints that have
+// not failed which resolved to the package built in dir
+func workloadUsers(tx *bolt.Tx, dir string) (WorkloadUsers, error) {
+	var users WorkloadUsers
+	if err := tx.Bucket(vmsBucket).ForEach(func(k, v []byte) error {
+		var rec VMRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return fmt.Errorf("failed to decode record for %s: %v", k, err)
+		}
+		if rec.Phase != PhaseDeleted && usesPackageIn(rec.Config.PackageSpec, dir) {
+			users.VMs = append(users.VMs, rec.Name)
+		}
+		return nil
+	}); err != nil {
+		return users, err
+	}
+	if err := tx.Bucket(blueprintsBucket).ForEach(func(k, v []byte) error {
+		var bp Blueprint
+		if err := json.Unmarshal(v, &bp); err != nil {
+			return fmt.Errorf("failed to decode blueprint %s: %v", k, err)
+		}
+		if bp.Phase != BlueprintFailed && usesPackageIn(bp.PackageSpec, dir) {
+			users.Blueprints = append(users.Blueprints, bp.Name)
+		}
+		return nil
+	}); err != nil {
+		return users, err
+	}
+	sort.Strings(users.VMs)
+	sort.Strings(users.Blueprints)
+	return users, nil
+}
+
+// ReplaceWorkload stores rec in place of any workload with the same name,
+// which needs replace and nothing using its package, since the rebuild
+// removes it. The check and the write share a transaction. It returns the
+// workload it replaced, or nil, and whatever is in the way.
+func (r *Registry) ReplaceWorkload(rec *WorkloadRecord, replace bool) (*WorkloadRecord, WorkloadUsers, error) {
+	var previous *WorkloadRecord
+	var users WorkloadUsers
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(workloadsBucket)
+
+		existing, err := getWorkload(b, rec.Name)
+		if err == nil {
+			previous = existing
+			if !replace {
+				return ErrWorkloadExists
+			}
+			if users, err = workloadUsers(tx, existing.Dir); err != nil {
+				return err
+			}
+			if len(users.VMs) > 0 || len(users.Blueprints) > 0 {
+				return ErrWorkloadInUse
+			}
+		} else if !errors.Is(err, ErrWorkloadNotFound) {
+			return err
+		}
+
+		now := time.Now().UTC()
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+		return putWorkload(b, rec)
+	})
+	return previous, users, err
+}
+
+// RestoreWorkload undoes a build that could not be queued: the workload goes
+// back to previous, or is removed if there was none. A workload that is no
+// longer building is left alone.
+func (r *Registry) RestoreWorkload(name string, previous *WorkloadRecord) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(workloadsBucket)
+
+		rec, err := getWorkload(b, name)
+		if err != nil {
+			return err
+		}
+		if rec.Phase != WorkloadBuilding {
+			return nil
+		}
+		if previous == nil {
+			return b.Delete([]byte(name))
+		}
+		log.Printf("Workload %s: back to %s, its build could not be queued", name, previous.Phase)
+		return putWorkload(b, previous)
+	})
+}
+
+// UpdateWorkload applies fn to the stored workload inside a single transaction
+func (r *Registry) UpdateWorkload(name string, fn func(rec *WorkloadRecord) error) (*WorkloadRecord, error) {
+	var rec *WorkloadRecord
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(workloadsBucket)
+
+		var err error
+		rec, err = getWorkload(b, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+
+		rec.UpdatedAt = time.Now().UTC()
+		return putWorkload(b, rec)
+	})
+	return rec, err
+}
+
+func (r *Registry) ListWorkloads() ([]*WorkloadRecord, error) {
+	var recs []*WorkloadRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(workloadsBucket).ForEach(func(k, v []byte) error {
+			var rec WorkloadRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("failed to decode workload %s: %v", k, err)
+			}
+			recs = append(recs, &rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+// imageSource turns an image reference into a skopeo source, assuming a
+// registry when no transport is given
+func imageSource(image string) string {
+	if strings.Contains(image, "://") || strings.HasPrefix(image, "oci:") || strings.HasPrefix(image, "oci-archive:") {
+		return image
+	}
+	return "docker://" + image
+}
+
+func (api *DrafterAPI) createWorkload(c *gin.Context) {
+	var req workloadRequest
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("Error parsing request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateName("workload", req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == api.config.Artifacts.defaultWorkload().Name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("workload name %q is reserved for the default workload", req.Name)})
+		return
+	}
+
+	var problems []string
+	switch {
+	case (req.Image == "") == (req.Layout == ""):
+		problems = append(problems, "exactly one of image and layout is needed")
+	case req.Layout != "":
+		if err := checkLocalPackage(req.Layout); err != nil {
+			problems = append(problems, fmt.Sprintf("layout: %v", err))
+		}
+		if req.Insecure {
+			problems = append(problems, "insecure only applies to image")
+		}
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port must be between 1 and 65535, got %d", req.Port))
+	}
+	if req.Size != "" {
+		if size, err := parseSize(req.Size); err != nil {
+			problems = append(problems, "size: "+err.Error())
+		} else if size == 0 {
+			problems = append(problems, "size must be positive")
+		}
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": strings.Join(problems, ", ")})
+		return
+	}
+
+	replace := false
+	if value := c.Query("replace"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid replace value %q", value)})
+			return
+		}
+		replace = parsed
+	}
+
+	owner := workloadOwner(req.Name)
+	if id, busy := api.jobs.Active(owner); busy {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("workload %s has job %s in progress", req.Name, id), "job_id": id})
+		return
+	}
+
+	// VMs and blueprints download or extract the package while they are
+	// built, and the rebuild removes it, so it waits until they are gone
+	rec := &WorkloadRecord{
+		Workload: Workload{Name: req.Name, Port: req.Port},
+		Phase:    WorkloadBuilding,
+		Image:    req.Image,
+		Layout:   req.Layout,
+		Insecure: req.Insecure,
+		Size:     req.Size,
+		Dir:      filepath.Join(api.config.DataRoot, workloadsKey, req.Name),
+	}
+	previous, users, err := api.registry.ReplaceWorkload(rec, replace)
+	switch {
+	case errors.Is(err, ErrWorkloadExists):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("workload %s already exists, pass replace=true to rebuild it", req.Name), "name": req.Name, "phase": previous.Phase})
+		return
+	case errors.Is(err, ErrWorkloadInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("workload %s is used by VMs or blueprints, delete them first", req.Name), "vms": users.VMs, "blueprints": users.Blueprints})
+		return
+	case err != nil:
+		log.Printf("Error storing workload %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store workload: %v", err)})
+		return
+	}
+
+	job, err := api.jobs.Submit("package", owner, packagePhases, func(run *JobRun) (gin.H, error) {
+		return api.runPackage(run, req.Name)
+	})
+	if err != nil {
+		if restoreErr := api.registry.RestoreWorkload(req.Name, previous); restoreErr != nil {
+			log.Printf("Error restoring workload %s: %v", req.Name, restoreErr)
+		}
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrVMBusy):
+			status = http.StatusConflict
+		case errors.Is(err, ErrJobQueueFull):
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Workload packaging queued",
+		"name":       req.Name,
+		"job_id":     job.ID,
+		"status_url": "/jobs/" + job.ID,
+	})
+}
+
+func (api *DrafterAPI) listWorkloads(c *gin.Context) {
+	recs, err := api.registry.ListWorkloads()
+	if err != nil {
+		log.Printf("Error listing workloads: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list workloads: %v", err)})
+		return
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Name < recs[j].Name })
+	if recs == nil {
+		recs = []*WorkloadRecord{}
+	}
+	c.JSON(http.StatusOK, gin.H{"workloads": recs})
+}
+
+func (api *DrafterAPI) getWorkload(c *gin.Context) {
+	name := c.Param("name")
+	rec, err := api.registry.GetWorkload(name)
+	if errors.Is(err, ErrWorkloadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("workload %s not found", name)})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading workload %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read workload: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// failWorkload records a failed packaging job
+func (api *DrafterAPI) failWorkload(name string, cause error) {
+	if _, err := api.registry.UpdateWorkload(name, func(rec *WorkloadRecord) error {
+		rec.Phase = WorkloadFailed
+		rec.Error = cause.Error()
+		return nil
+	}); err != nil {
+		log.Printf("Error marking workload %s as failed: %v", name, err)
+	}
+}
+
+// runPackage builds a drafter package from a container image: the image's
+// OCI layout goes into an ext4 filesystem, which drafter-packager wraps as
+// the package's oci device
+func (api *DrafterAPI) runPackage(run *JobRun, name string) (result gin.H, err error) {
+	rec, err := api.registry.GetWorkload(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workload: %v", err)
+	}
+
+	defer func() {
+		if err != nil {
+			api.failWorkload(name, err)
+		}
+	}()
+
+	layoutDir := filepath.Join(rec.Dir, "image")
+	ext4Path := filepath.Join(rec.Dir, "oci.ext4")
+	packagePath := filepath.Join(rec.Dir, fmt.Sprintf("oci-%s.tar.zst", name))
+
+	run.Phase("fetch")
+	if err := api.config.Artifacts.checkDrafterVersion(); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(rec.Dir); err != nil {
+		log.Printf("Error cleaning up workload %s: %v", name, err)
+	}
+	if err := os.MkdirAll(layoutDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", layoutDir, err)
+	}
+	if rec.Image != "" {
+		// The VMs are x86_64 whatever host the image is pulled on
+		args := []string{"copy", "--override-arch", "amd64"}
+		if rec.Insecure {
+			args = append(args, "--src-tls-verify=false")
+		}
+		args = append(args, imageSource(rec.Image), "oci:"+layoutDir+":latest")
+		if _, err := runCommandWithOutput(exec.Command("skopeo", args...)); err != nil {
+			return nil, fmt.Errorf("failed to copy image %s: %v", rec.Image, err)
+		}
+	} else {
+		if _, err := runCommandWithOutput(exec.Command("tar", "-xf", rec.Layout, "-C", layoutDir)); err != nil {
+			return nil, fmt.Errorf("failed to unpack layout %s: %v", rec.Layout, err)
+		}
+	}
+
+	port, err := imageLayoutPort(layoutDir)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Port == 0 && port == 0 {
+		return nil, errors.New("the image exposes no TCP port, pass port")
+	}
+
+	run.Phase("ext4")
+	size, err := ext4Size(layoutDir, rec.Size)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ext4Path, nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", ext4Path, err)
+	}
+	if err := os.Truncate(ext4Path, size); err != nil {
+		return nil, fmt.Errorf("failed to size %s: %v", ext4Path, err)
+	}
+	if _, err := runCommandWithOutput(exec.Command("sudo", "mkfs.ext4", "-q", "-F", "-d", layoutDir, ext4Path)); err != nil {
+		return nil, fmt.Errorf("failed to build ext4 filesystem: %v", err)
+	}
+
+	run.Phase("package")
+	devices, err := packagerDevicesJSON(rec.Dir, "oci")
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI devices: %v", err)
+	}
+	if _, err := runCommandWithOutput(exec.Command("sudo", api.config.Artifacts.binary("drafter-packager"),
+		"--package-path", packagePath,
+		"--devices", devices)); err != nil {
+		return nil, fmt.Errorf("failed to package %s: %v", name, err)
+	}
+	if err := checkLocalPackage(packagePath); err != nil {
+		return nil, fmt.Errorf("drafter-packager wrote no package: %v", err)
+	}
+	// The ext4 image and package were written by root
+	if err := api.config.chownToServiceUser(rec.Dir); err != nil {
+		return nil, fmt.Errorf("failed to set permissions: %v", err)
+	}
+
+	run.Phase("register")
+	// The layout and ext4 image are inside the package now
+	for _, path := range []string{layoutDir, ext4Path} {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Error removing %s: %v", path, err)
+		}
+	}
+	rec, err = api.registry.UpdateWorkload(name, func(rec *WorkloadRecord) error {
+		rec.Phase = WorkloadReady
+		rec.Error = ""
+		rec.Package = packagePath
+		rec.Ext4 = size
+		if rec.Port == 0 {
+			rec.Port = port
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update workload: %v", err)
+	}
+
+	log.Printf("Workload packaged successfully: %s", name)
+	return gin.H{
+		"message":  "Workload packaged",
+		"name":     name,
+		"workload": rec.Workload,
+	}, nil
+}
+
+// ext4Size is the requested size, or room for the layout plus slack for the
+// guest to unpack it
+func ext4Size(layoutDir, requested string) (int64, error) {
+	var used int64
+	if err := filepath.WalkDir(layoutDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			used += info.Size()
+		}
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %v", layoutDir, err)
+	}
+
+	if requested == "" {
+		size := used*ext4Slack + ext4Headroom
+		// Round up to a whole MiB
+		return (size + 1<<20 - 1) &^ (1<<20 - 1), nil
+	}
+	size, err := parseSize(requested)
+	if err != nil {
+		return 0, err
+	}
+	if size < used {
+		return 0, fmt.Errorf("size %s is smaller than the image's %d bytes", requested, used)
+	}
+	return size, nil
+}
+
+// ociDescriptor is the part of an OCI descriptor the API reads
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+func readBlob(layoutDir, digest string, v interface{}) error {
+	algorithm, hex, ok := strings.Cut(digest, ":")
+	if !ok {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	data, err := os.ReadFile(filepath.Join(layoutDir, "blobs", algorithm, hex))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// imageLayoutPort checks that layoutDir holds an OCI image layout and
+// returns the first TCP port its image exposes, or 0
+func imageLayoutPort(layoutDir string) (int, error) {
+	if _, err := os.Stat(filepath.Join(layoutDir, "oci-layout")); err != nil {
+		return 0, fmt.Errorf("not an OCI image layout: %v", err)
+	}
+
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := readBlobFile(filepath.Join(layoutDir, "index.json"), &index); err != nil {
+		return 0, fmt.Errorf("failed to read index.json: %v", err)
+	}
+
+	// A layout may hold an index of images for several platforms
+	for depth := 0; depth < 2 && len(index.Manifests) > 0; depth++ {
+		desc, err := pickManifest(index.Manifests)
+		if err != nil {
+			return 0, err
+		}
+		if !strings.Contains(desc.MediaType, "index") && !strings.Contains(desc.MediaType, "manifest.list") {
+			var manifest struct {
+				Config ociDescriptor `json:"config"`
+			}
+			if err := readBlob(layoutDir, desc.Digest, &manifest); err != nil {
+				return 0, fmt.Errorf("failed to read manifest: %v", err)
+			}
+			var config struct {
+				Architecture string `json:"architecture"`
+				Config       struct {
+					ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+				} `json:"config"`
+			}
+			if err := readBlob(layoutDir, manifest.Config.Digest, &config); err != nil {
+				return 0, fmt.Errorf("failed to read image config: %v", err)
+			}
+			if config.Architecture != "" && config.Architecture != "amd64" {
+				return 0, fmt.Errorf("the image is built for %s, the VMs run amd64", config.Architecture)
+			}
+			return exposedTCPPort(config.Config.ExposedPorts), nil
+		}
+		index.Manifests = nil
+		if err := readBlob(layoutDir, desc.Digest, &index); err != nil {
+			return 0, fmt.Errorf("failed to read image index: %v", err)
+		}
+	}
+	return 0, errors.New("the image layout has no manifest")
+}
+
+func readBlobFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// pickManifest picks the amd64 image, which is what the VMs run. A manifest
+// without a platform is taken as is; an index that only has images for other
+// platforms is an error.
+func pickManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, m := range manifests {
+		if m.Platform != nil && m.Platform.Architecture == "amd64" {
+			return m, nil
+		}
+	}
+	var others []string
+	for _, m := range manifests {
+		if m.Platform == nil {
+			return m, nil
+		}
+		others = append(others, m.Platform.Architecture)
+	}
+	return ociDescriptor{}, fmt.Errorf("the image has no amd64 variant, only %s", strings.Join(others, ", "))
+}
+
+// exposedTCPPort returns the lowest TCP port of an image's ExposedPorts
+func exposedTCPPort(exposed map[string]struct{}) int {
+	lowest := 0
+	for spec := range exposed {
+		port, protocol, _ := strings.Cut(spec, "/")
+		if protocol != "" && protocol != "tcp" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err == nil && n > 0 && n <= 65535 && (lowest == 0 || n < lowest) {
+			lowest = n
+		}
+	}
+	return lowest
+}
+
+// registeredWorkload fills in the package and port of a workload that names
+// a packaged workload without giving its own package
+func (api *DrafterAPI) registeredWorkload(spec *PackageSpec) error {
+	w := spec.Workload
+	if w == nil || w.Package != "" || spec.ImagePath != "" || w.Name == "" || w.Name == api.config.Artifacts.defaultWorkload().Name {
+		return nil
+	}
+
+	rec, err := api.registry.GetWorkload(w.Name)
+	if errors.Is(err, ErrWorkloadNotFound) {
+		return fmt.Errorf("workload %s is not registered and has no package", w.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read workload %s: %v", w.Name, err)
+	}
+	if rec.Phase != WorkloadReady {
+		return fmt.Errorf("workload %s is %s, not ready", w.Name, rec.Phase)
+	}
+
+	resolved := rec.Workload
+	if w.Port != 0 {
+		resolved.Port = w.Port
+	}
+	spec.Workload = &resolved
+	return nil
+}
+
+// reconcileWorkloads fails packaging jobs that an API restart cut short
+func (api *DrafterAPI) reconcileWorkloads() error {
+	recs, err := api.registry.ListWorkloads()
+	if err != nil {
+		return fmt.Errorf("failed to list workloads: %v", err)
+	}
+	for _, rec := range recs {
+		if rec.Phase != WorkloadBuilding {
+			continue
+		}
+		api.failWorkload(rec.Name, errors.New("interrupted by API restart"))
+		log.Printf("Reconcile: marked workload %s as failed: interrupted by API restart", rec.Name)
+	}
+	return nil
+}
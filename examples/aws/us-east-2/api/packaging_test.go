@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ociFixture builds an OCI image layout in a temporary directory
+type ociFixture struct {
+	t   *testing.T
+	dir string
+}
+
+func newOCIFixture(t *testing.T) *ociFixture {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &ociFixture{t: t, dir: dir}
+}
+
+// blob stores v as a JSON blob and returns its digest
+func (f *ociFixture) blob(v interface{}) string {
+	f.t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(f.dir, "blobs", "sha256", digest), data, 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	return "sha256:" + digest
+}
+
+// image stores an amd64 image config exposing ports and its manifest, and
+// returns the manifest's digest
+func (f *ociFixture) image(ports ...string) string {
+	return f.imageFor("amd64", ports...)
+}
+
+func (f *ociFixture) imageFor(arch string, ports ...string) string {
+	exposed := map[string]struct{}{}
+	for _, port := range ports {
+		exposed[port] = struct{}{}
+	}
+	config := f.blob(map[string]interface{}{
+		"architecture": arch,
+		"config":       map[string]interface{}{"ExposedPorts": exposed},
+	})
+	return f.blob(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]string{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": config},
+	})
+}
+
+func (f *ociFixture) index(manifests ...map[string]interface{}) {
+	f.t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": manifests})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(f.dir, "index.json"), data, 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func manifestDesc(digest, arch string) map[string]interface{} {
+	desc := map[string]interface{}{
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"digest":    digest,
+	}
+	if arch != "" {
+		desc["platform"] = map[string]string{"architecture": arch, "os": "linux"}
+	}
+	return desc
+}
+
+func TestImageLayoutPort(t *testing.T) {
+	t.Run("single image", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index(manifestDesc(f.image("6379/tcp", "8080/tcp"), ""))
+		port, err := imageLayoutPort(f.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != 6379 {
+			t.Errorf("port = %d, want 6379", port)
+		}
+	})
+
+	t.Run("multi-platform index", func(t *testing.T) {
+		f := newOCIFixture(t)
+		nested := f.blob(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.index.v1+json",
+			"manifests": []map[string]interface{}{
+				manifestDesc(f.image("9000/tcp"), "arm64"),
+				manifestDesc(f.image("80/tcp", "53/udp"), "amd64"),
+			},
+		})
+		f.index(map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.index.v1+json",
+			"digest":    nested,
+		})
+		port, err := imageLayoutPort(f.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != 80 {
+			t.Errorf("port = %d, want 80 from the amd64 image", port)
+		}
+	})
+
+	t.Run("no amd64 image", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index(manifestDesc(f.imageFor("arm64", "80/tcp"), "arm64"))
+		if _, err := imageLayoutPort(f.dir); err == nil || !strings.Contains(err.Error(), "arm64") {
+			t.Errorf("imageLayoutPort() = %v, want an error naming arm64", err)
+		}
+	})
+
+	t.Run("image for another architecture", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index(manifestDesc(f.imageFor("arm64", "80/tcp"), ""))
+		if _, err := imageLayoutPort(f.dir); err == nil {
+			t.Error("expected an error for an arm64 image")
+		}
+	})
+
+	t.Run("no exposed ports", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index(manifestDesc(f.image(), ""))
+		port, err := imageLayoutPort(f.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != 0 {
+			t.Errorf("port = %d, want 0", port)
+		}
+	})
+
+	t.Run("empty index", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index()
+		if _, err := imageLayoutPort(f.dir); err == nil {
+			t.Error("expected an error for a layout without manifests")
+		}
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		f := newOCIFixture(t)
+		f.index(manifestDesc("sha256:0000", ""))
+		if _, err := imageLayoutPort(f.dir); err == nil {
+			t.Error("expected an error for a missing manifest")
+		}
+	})
+
+	t.Run("not a layout", func(t *testing.T) {
+		if _, err := imageLayoutPort(t.TempDir()); err == nil {
+			t.Error("expected an error for a directory without oci-layout")
+		}
+	})
+}
+
+func TestPickManifest(t *testing.T) {
+	desc := func(digest, arch string) ociDescriptor {
+		d := ociDescriptor{Digest: digest}
+		if arch != "" {
+			d.Platform = &struct {
+				Architecture string `json:"architecture"`
+			}{Architecture: arch}
+		}
+		return d
+	}
+
+	tests := []struct {
+		name      string
+		manifests []ociDescriptor
+		want      string
+	}{
+		{"amd64 preferred", []ociDescriptor{desc("a", "arm64"), desc("b", "amd64")}, "b"},
+		{"amd64 over no platform", []ociDescriptor{desc("a", ""), desc("b", "amd64")}, "b"},
+		{"no platform", []ociDescriptor{desc("a", ""), desc("b", "")}, "a"},
+		{"no platform over another", []ociDescriptor{desc("a", "arm64"), desc("b", "")}, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pickManifest(tt.manifests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Digest != tt.want {
+				t.Errorf("pickManifest() = %s, want %s", got.Digest, tt.want)
+			}
+		})
+	}
+
+	_, err := pickManifest([]ociDescriptor{desc("a", "arm64"), desc("b", "s390x")})
+	if err == nil || !strings.Contains(err.Error(), "arm64, s390x") {
+		t.Errorf("pickManifest() without amd64 = %v, want an error listing the platforms", err)
+	}
+}
+
+func TestExposedTCPPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		exposed []string
+		want    int
+	}{
+		{"none", nil, 0},
+		{"lowest tcp", []string{"8080/tcp", "443/tcp"}, 443},
+		{"no protocol is tcp", []string{"3000"}, 3000},
+		{"udp skipped", []string{"53/udp", "8080/tcp"}, 8080},
+		{"only udp", []string{"53/udp"}, 0},
+		{"out of range", []string{"0/tcp", "70000/tcp", "abc/tcp"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exposed := map[string]struct{}{}
+			for _, port := range tt.exposed {
+				exposed[port] = struct{}{}
+			}
+			if got := exposedTCPPort(exposed); got != tt.want {
+				t.Errorf("exposedTCPPort(%v) = %d, want %d", tt.exposed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExt4Size(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "layer"), make([]byte, 3<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "config"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	used := int64(3<<20 + 100)
+
+	t.Run("default", func(t *testing.T) {
+		size, err := ext4Size(dir, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size%(1<<20) != 0 {
+			t.Errorf("size %d is not a whole MiB", size)
+		}
+		if min := used*ext4Slack + ext4Headroom; size < min || size >= min+1<<20 {
+			t.Errorf("size = %d, want %d rounded up to a MiB", size, min)
+		}
+	})
+
+	t.Run("requested", func(t *testing.T) {
+		size, err := ext4Size(dir, "1G")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != 1<<30 {
+			t.Errorf("size = %d, want %d", size, 1<<30)
+		}
+	})
+
+	t.Run("too small", func(t *testing.T) {
+		if _, err := ext4Size(dir, "1M"); err == nil {
+			t.Error("expected an error for a size below the image's")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := ext4Size(dir, "lots"); err == nil {
+			t.Error("expected an error for an invalid size")
+		}
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		if _, err := ext4Size(filepath.Join(dir, "missing"), ""); err == nil {
+			t.Error("expected an error for a missing layout")
+		}
+	})
+}
+
+func TestReplaceWorkload(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	dir := "/data/_workloads/app"
+	built := &Workload{Name: "app", Package: dir + "/oci-app.tar.zst", Port: 8080}
+	other := &Workload{Name: "other", Package: "/data/_workloads/app2/oci-app2.tar.zst", Port: 8080}
+	for _, rec := range []*VMRecord{
+		{Name: "vm-1", Phase: PhaseRunning, Config: VMConfig{PackageSpec: PackageSpec{Workload: built}}},
+		{Name: "vm-gone", Phase: PhaseDeleted, Config: VMConfig{PackageSpec: PackageSpec{Workload: built}}},
+		{Name: "vm-other", Phase: PhaseRunning, Config: VMConfig{PackageSpec: PackageSpec{Workload: other}}},
+	} {
+		if err := reg.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bp := range []*Blueprint{
+		{Name: "base", Phase: BlueprintReady, PackageSpec: PackageSpec{Workload: built}},
+		{Name: "broken", Phase: BlueprintFailed, PackageSpec: PackageSpec{Workload: built}},
+	} {
+		if _, _, err := reg.ReplaceBlueprint(bp, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ready := &WorkloadRecord{Workload: *built, Phase: WorkloadReady, Dir: dir}
+	if _, _, err := reg.ReplaceWorkload(ready, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuild := func() *WorkloadRecord {
+		return &WorkloadRecord{Workload: Workload{Name: "app"}, Phase: WorkloadBuilding, Dir: dir}
+	}
+	if previous, _, err := reg.ReplaceWorkload(rebuild(), false); !errors.Is(err, ErrWorkloadExists) || previous == nil {
+		t.Errorf("ReplaceWorkload() without replace = %v, want ErrWorkloadExists", err)
+	}
+	_, users, err := reg.ReplaceWorkload(rebuild(), true)
+	if !errors.Is(err, ErrWorkloadInUse) {
+		t.Fatalf("ReplaceWorkload() in use = %v, want ErrWorkloadInUse", err)
+	}
+	if !reflect.DeepEqual(users.VMs, []string{"vm-1"}) || !reflect.DeepEqual(users.Blueprints, []string{"base"}) {
+		t.Errorf("users = %+v, want vm-1 and blueprint base", users)
+	}
+	if rec, err := reg.GetWorkload("app"); err != nil || rec.Phase != WorkloadReady {
+		t.Errorf("GetWorkload(app) = %+v, %v, a refused rebuild changed it", rec, err)
+	}
+
+	// Once nothing uses it, it is rebuilt, and put back if the build
+	// cannot be queued
+	if _, err := reg.Transition("vm-1", PhaseDeleted, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.UpdateBlueprint("base", func(bp *Blueprint) error {
+		bp.Phase = BlueprintFailed
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	previous, _, err := reg.ReplaceWorkload(rebuild(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RestoreWorkload("app", previous); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := reg.GetWorkload("app"); err != nil || rec.Phase != WorkloadReady || rec.Package != built.Package {
+		t.Errorf("GetWorkload(app) = %+v, %v, want the ready workload back", rec, err)
+	}
+
+	// A new workload whose build cannot be queued is removed
+	if _, _, err := reg.ReplaceWorkload(&WorkloadRecord{Workload: Workload{Name: "new"}, Phase: WorkloadBuilding}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RestoreWorkload("new", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.GetWorkload("new"); !errors.Is(err, ErrWorkloadNotFound) {
+		t.Errorf("GetWorkload(new) = %v, want ErrWorkloadNotFound", err)
+	}
+}
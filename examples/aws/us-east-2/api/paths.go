@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultDataRoot    = "/home/ec2-user/out"
+	defaultLogRoot     = "/home/ec2-user/drafter-api/logs"
+	defaultServiceUser = "ec2-user"
+)
+
+// serviceOwner is the chown argument for the service user
+func (cfg Config) serviceOwner() string {
+	// A user alone gets their login group
+	if !strings.Contains(cfg.ServiceUser, ":") {
+		return cfg.ServiceUser + ":"
+	}
+	return cfg.ServiceUser
+}
+
+// chownToServiceUser hands a tree built by root over to the service user
+func (cfg Config) chownToServiceUser(dir string) error {
+	return exec.Command("sudo", "chown", "-R", cfg.serviceOwner(), dir).Run()
+}
+
+var vmNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+
+// validateVMName makes sure a name is safe to use as a directory name
+func validateVMName(name string) error {
+	return validateName("VM", name)
+}
+
+// validateName checks the name of a VM, blueprint or workload
+func validateName(kind, name string) error {
+	if !vmNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name %q: must be 1-63 characters of letters, digits, '.', '_' or '-' and start with a letter or digit", kind, name)
+	}
+	return nil
+}
+
+// packageFiles maps each drafter device to its file name inside a package
+var packageFiles = []struct {
+	Device string
+	File   string
+	Input  bool
+}{
+	{Device: "state", File: "state.bin"},
+	{Device: "memory", File: "memory.bin"},
+	{Device: "kernel", File: "vmlinux", Input: true},
+	{Device: "disk", File: "rootfs.ext4", Input: true},
+	{Device: "config", File: "config.json"},
+	{Device: "oci", File: "oci.ext4", Input: true},
+}
+
+// setVMPaths fills in the per-VM directory tree under the data root
+func (cfg Config) setVMPaths(rec *VMRecord) {
+	rec.BaseDir = filepath.Join(cfg.DataRoot, rec.Name)
+	rec.BlueprintDir = filepath.Join(rec.BaseDir, "blueprint")
+	rec.PackageDir = filepath.Join(rec.BaseDir, "package")
+	rec.InstanceDir = filepath.Join(rec.BaseDir, "instance")
+	rec.OverlayDir = filepath.Join(rec.InstanceDir, "overlay")
+	rec.StateDir = filepath.Join(rec.InstanceDir, "state")
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestValidateVMName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"vm-1", false},
+		{"web.prod_2", false},
+		{"A", false},
+		{"", true},
+		{"-vm", true},
+		{".hidden", true},
+		{"../etc", true},
+		{"vm/1", true},
+		{"vm 1", true},
+		{"a234567890123456789012345678901234567890123456789012345678901234", true},
+	}
+	for _, tt := range tests {
+		if err := validateVMName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateVMName(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetVMPaths(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DataRoot = "/srv/drafter"
+	rec := &VMRecord{Name: "vm-1"}
+	cfg.setVMPaths(rec)
+
+	tests := []struct {
+		dir       string
+		got, want string
+	}{
+		{"base", rec.BaseDir, "/srv/drafter/vm-1"},
+		{"blueprint", rec.BlueprintDir, "/srv/drafter/vm-1/blueprint"},
+		{"package", rec.PackageDir, "/srv/drafter/vm-1/package"},
+		{"instance", rec.InstanceDir, "/srv/drafter/vm-1/instance"},
+		{"overlay", rec.OverlayDir, "/srv/drafter/vm-1/instance/overlay"},
+		{"state", rec.StateDir, "/srv/drafter/vm-1/instance/state"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s dir = %q, want %q", tt.dir, tt.got, tt.want)
+		}
+	}
+}
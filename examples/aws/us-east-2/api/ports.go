@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Port keys stored in VMRecord.Ports
+const (
+	PortForward = "forward"
+	PortPeer    = "peer"
+)
+
+var ErrNoFreePort = errors.New("no free port")
+
+// PortAllocator hands out host ports for drafter-forwarder and drafter-peer.
+// Assignments live in the registry; a port is only handed out if no other
+// VM holds it and nothing on the host is currently bound to it.
+type PortAllocator struct {
+	registry *Registry
+}
+
+func NewPortAllocator(registry *Registry) *PortAllocator {
+	return &PortAllocator{registry: registry}
+}
+
+func portFree(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// Acquire assigns a free port in [first, last] to the VM under key, or
+// returns the port it already holds for that key
+func (a *PortAllocator) Acquire(vmName, key, host string, first, last int) (int, error) {
+	rec, err := a.registry.UpdateWithOthers(vmName, func(rec *VMRecord, others []*VMRecord) error {
+		if rec.Ports[key] != 0 {
+			return nil
+		}
+
+		used := make(map[int]bool)
+		for _, other := range others {
+			for _, port := range other.Ports {
+				used[port] = true
+			}
+		}
+		for _, port := range rec.Ports {
+			used[port] = true
+		}
+
+		for port := first; port <= last; port++ {
+			if used[port] || !portFree(host, port) {
+				continue
+			}
+			if rec.Ports == nil {
+				rec.Ports = make(map[string]int)
+			}
+			rec.Ports[key] = port
+			return nil
+		}
+		return fmt.Errorf("%w: all ports in %d-%d are in use", ErrNoFreePort, first, last)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Assigned %s port %d to VM %s", key, rec.Ports[key], vmName)
+	return rec.Ports[key], nil
+}
+
+// Release returns all of the VM's ports to the pool
+func (a *PortAllocator) Release(vmName string) error {
+	_, err := a.registry.Update(vmName, func(rec *VMRecord) error {
+		if len(rec.Ports) > 0 {
+			log.Printf("Released ports %v from VM %s", rec.Ports, vmName)
+		}
+		rec.Ports = nil
+		return nil
+	})
+	return err
+}
+
+func (api *DrafterAPI) acquireForwardPort(vmName string) (int, error) {
+	return api.ports.Acquire(vmName, PortForward, api.config.ForwardHost, api.config.ForwardPortStart, api.config.ForwardPortEnd)
+}
+
+// acquirePeerPort picks the port drafter-peer listens on for outgoing migrations
+func (api *DrafterAPI) acquirePeerPort(vmName string) (int, error) {
+	return api.ports.Acquire(vmName, PortPeer, "", api.config.PeerPortStart, api.config.PeerPortStart+api.config.NetnsPoolSize-1)
+}
+
+// endpoints returns the reachable addresses for a VM's allocated ports
+func (api *DrafterAPI) endpoints(rec *VMRecord) map[string]string {
+	endpoints := make(map[string]string)
+	if port := rec.Ports[PortForward]; port != 0 {
+		endpoints[PortForward] = net.JoinHostPort(api.config.ForwardHost, strconv.Itoa(port))
+	}
+	if port := rec.Ports[PortPeer]; port != 0 {
+		endpoints[PortPeer] = fmt.Sprintf(":%d", port)
+	}
+	return endpoints
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// freePorts finds count consecutive ports nothing on the host is bound to
+func freePorts(t *testing.T, count int) int {
+	t.Helper()
+	for attempt := 0; attempt < 50; attempt++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		free := first+count-1 <= 65535
+		for port := first; free && port < first+count; port++ {
+			free = portFree("127.0.0.1", port)
+		}
+		if free {
+			return first
+		}
+	}
+	t.Fatalf("no %d consecutive free ports", count)
+	return 0
+}
+
+func TestPortAllocator(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	a := NewPortAllocator(reg)
+	for _, name := range []string{"vm-1", "vm-2"} {
+		if err := reg.Put(&VMRecord{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := freePorts(t, 3)
+	last := first + 2
+	// Something outside the registry is bound to the first port
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	acquire := func(vm, key string, want int) {
+		t.Helper()
+		port, err := a.Acquire(vm, key, "127.0.0.1", first, last)
+		if err != nil {
+			t.Fatalf("Acquire(%s, %s) = %v", vm, key, err)
+		}
+		if port != want {
+			t.Errorf("Acquire(%s, %s) = %d, want %d", vm, key, port, want)
+		}
+	}
+	acquire("vm-1", PortForward, first+1)
+	// A VM keeps the port it holds, and its own ports are not handed out again
+	acquire("vm-1", PortForward, first+1)
+	acquire("vm-1", PortPeer, first+2)
+	if _, err := a.Acquire("vm-2", PortForward, "127.0.0.1", first, last); !errors.Is(err, ErrNoFreePort) {
+		t.Errorf("Acquire() from an exhausted range = %v, want ErrNoFreePort", err)
+	}
+
+	if err := a.Release("vm-1"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := reg.Get("vm-1"); len(rec.Ports) != 0 {
+		t.Errorf("released VM still holds %v", rec.Ports)
+	}
+	acquire("vm-2", PortForward, first+1)
+}
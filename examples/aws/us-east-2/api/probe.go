@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	probeInterval = 250 * time.Millisecond
+	// drafter-peer logs this once the VM is running again
+	peerResumedMarker = "Resumed VM"
+)
+
+// waitReady polls probe until it succeeds. probe returns why the component
+// is not ready yet. It fails early if the supervised process exits, and
+// after timeout with the last reason the probe gave.
+func (api *DrafterAPI) waitReady(vm, component string, timeout time.Duration, probe func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probe()
+		if err == nil {
+			return nil
+		}
+
+		if status, ok := api.supervisor.Status(vm, component); ok && !status.Running {
+			return fmt.Errorf("%s exited before becoming ready: %s", component, exitDescription(status))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not ready after %s: %v", component, timeout, err)
+		}
+		time.Sleep(probeInterval)
+	}
+}
+
+// natReady checks that drafter-nat has created the first namespace of the
+// pool and wired up its veth
+func (a *NetnsAllocator) natReady() error {
+	name := a.name(0)
+	if !a.exists(name) {
+		return fmt.Errorf("netns %s does not exist yet", name)
+	}
+	out, err := exec.Command("sudo", "ip", "-n", name, "-o", "link", "show", "type", "veth").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list links in netns %s: %v", name, err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return fmt.Errorf("netns %s has no veth yet", name)
+	}
+	return nil
+}
+
+// TCP socket states in /proc/net/tcp
+const (
+	tcpEstablished = "01"
+	tcpListen      = "0A"
+)
+
+// tcpSocket reports whether /proc/net/tcp lists a socket on local port in
+// state
+func tcpSocket(port int, state string) bool {
+	want := fmt.Sprintf(":%04X", port)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// local_address is field 1 and st is field 3
+			if len(fields) > 3 && strings.HasSuffix(fields[1], want) && fields[3] == state {
+				f.Close()
+				return true
+			}
+		}
+		f.Close()
+	}
+	return false
+}
+
+// portListening checks /proc/net/tcp for a listening socket on port, without
+// connecting to it
+func portListening(port int) error {
+	if !tcpSocket(port, tcpListen) {
+		return fmt.Errorf("nothing listening on port %d yet", port)
+	}
+	return nil
+}
+
+// portConnected reports whether anything is connected to local port
+func portConnected(port int) bool {
+	return tcpSocket(port, tcpEstablished)
+}
+
+// logContains checks a log file for a marker line
+func logContains(path, marker string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if !strings.Contains(string(data), marker) {
+		return fmt.Errorf("%q not logged yet", marker)
+	}
+	return nil
+}
+
+// tcpConnect checks that addr accepts TCP connections
+func tcpConnect(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// peerReady waits for a peer to resume its VM, or to start listening for
+// migrations when it has a port
+func (api *DrafterAPI) peerReady(vm string, logManager *LogManager, port int) error {
+	logPath := logManager.LogPath("peer")
+	return api.waitReady(vm, "peer", api.config.PeerReadyTimeout, func() error {
+		err := logContains(logPath, peerResumedMarker)
+		if err != nil && port != 0 {
+			if portErr := portListening(port); portErr == nil {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// forwarderReady waits for the forwarded port to accept connections
+func (api *DrafterAPI) forwarderReady(vm, addr string) error {
+	return api.waitReady(vm, "forwarder", api.config.ForwarderReadyTimeout, func() error {
+		return tcpConnect(addr)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPortConnected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if err := portListening(port); err != nil {
+		t.Errorf("portListening() = %v for a listening port", err)
+	}
+	if portConnected(port) {
+		t.Error("portConnected() = true before anything connected")
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !portConnected(port) {
+		t.Error("portConnected() = false with a connection open")
+	}
+
+	conn.Close()
+	accepted.Close()
+	if portConnected(port) {
+		t.Error("portConnected() = true after the connection closed")
+	}
+}
+
+func TestLogContains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.log")
+	if err := logContains(path, peerResumedMarker); err == nil {
+		t.Error("logContains() = nil for a missing log")
+	}
+	if err := os.WriteFile(path, []byte("Starting peer\n"+peerResumedMarker+" in 1.2s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := logContains(path, peerResumedMarker); err != nil {
+		t.Errorf("logContains() = %v with the marker logged", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	api := &DrafterAPI{supervisor: NewSupervisor()}
+
+	// Ready on the third probe
+	probes := 0
+	if err := api.waitReady("vm", "forwarder", 5*time.Second, func() error {
+		if probes++; probes < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}); err != nil || probes != 3 {
+		t.Errorf("waitReady() = %v after %d probes, want ready after 3", err, probes)
+	}
+
+	err := api.waitReady("vm", "forwarder", 100*time.Millisecond, func() error {
+		return errors.New("connection refused")
+	})
+	if err == nil || !strings.Contains(err.Error(), "not ready after 100ms: connection refused") {
+		t.Errorf("waitReady() = %v, want a timeout with the last reason", err)
+	}
+
+	// A process that exits is not waited for until the timeout
+	if _, err := api.supervisor.Start(ProcessSpec{VM: "vm", Component: "peer", Args: []string{"sh", "-c", "echo no kvm >&2; exit 1"}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = api.waitReady("vm", "peer", time.Minute, func() error {
+		return errors.New("not resumed yet")
+	})
+	if err == nil || !strings.Contains(err.Error(), "exited before becoming ready") || !strings.Contains(err.Error(), "no kvm") {
+		t.Errorf("waitReady() = %v, want the exit and its output", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("waitReady() waited for the timeout after the process exited")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// drafterBinaries maps the binaries the API runs to their component
+var drafterBinaries = map[string]string{
+	"drafter-nat":         "nat",
+	"drafter-snapshotter": "snapshotter",
+	"drafter-peer":        "peer",
+	"drafter-forwarder":   "forwarder",
+	"firecracker":         "firecracker",
+}
+
+// drafterProcess is a drafter process found in /proc
+type drafterProcess struct {
+	PID       int
+	PPID      int
+	Args      []string
+	Component string
+	StartedAt time.Time
+}
+
+// scanDrafterProcesses lists every running drafter process on the host
+func scanDrafterProcesses() ([]*drafterProcess, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /proc: %v", err)
+	}
+
+	var procs []*drafterProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+
+		cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		component := drafterComponent(args)
+		if component == "" {
+			continue
+		}
+
+		proc := &drafterProcess{PID: pid, Args: args, Component: component}
+		if stat, err := os.ReadFile(filepath.Join(dir, "stat")); err == nil {
+			fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+			if len(fields) >= 2 {
+				proc.PPID, _ = strconv.Atoi(fields[1])
+			}
+		}
+		// /proc/<pid> is created when the process starts
+		if info, err := os.Stat(dir); err == nil {
+			proc.StartedAt = info.ModTime()
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+// drafterComponent returns the component a command line runs, looking past
+// sudo and its options
+func drafterComponent(args []string) string {
+	for i, arg := range args {
+		if component, ok := drafterBinaries[filepath.Base(arg)]; ok {
+			return component
+		}
+		if i == 0 && filepath.Base(arg) == "sudo" {
+			continue
+		}
+		if i > 0 && strings.HasPrefix(arg, "-") {
+			continue
+		}
+		return ""
+	}
+	return ""
+}
+
+// argValue returns the value of a --flag value or --flag=value argument
+func argValue(args []string, flag string) string {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, flag+"=") {
+			return strings.TrimPrefix(arg, flag+"=")
+		}
+	}
+	return ""
+}
+
+// devicesVM finds the VM a --devices argument belongs to from the paths in
+// it, or the owner of the blueprint when they are under _blueprints/<name>,
+// taking them relative to the data root
+func devicesVM(dataRoot, devices string) string {
+	var parsed []map[string]interface{}
+	if err := json.Unmarshal([]byte(devices), &parsed); err != nil {
+		return ""
+	}
+	// Clones read their base from another VM's package, so the paths a
+	// process writes to are checked first
+	for _, device := range parsed {
+		for _, key := range []string{"overlay", "state", "output", "base", "input"} {
+			path, ok := device[key].(string)
+			if !ok {
+				continue
+			}
+			rel, err := filepath.Rel(dataRoot, path)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			parts := strings.Split(rel, string(filepath.Separator))
+			if parts[0] == blueprintsKey {
+				if len(parts) > 1 && validateName("blueprint", parts[1]) == nil {
+					return blueprintOwner(parts[1])
+				}
+				continue
+			}
+			if validateVMName(parts[0]) == nil {
+				return parts[0]
+			}
+		}
+	}
+	return ""
+}
+
+func parsePortForwards(value string) []portForward {
+	var forwards []portForward
+	if err := json.Unmarshal([]byte(value), &forwards); err != nil {
+		return nil
+	}
+	return forwards
+}
+
+// addrPort returns the port of a host:port or :port address
+func addrPort(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// reconcile adopts drafter processes left running by an earlier run of the
+// API and fails records whose processes are gone
+func (api *DrafterAPI) reconcile() error {
+	procs, err := scanDrafterProcesses()
+	if err != nil {
+		log.Printf("Error scanning for drafter processes: %v", err)
+	}
+
+	records, err := api.registry.List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %v", err)
+	}
+	byName := make(map[string]*VMRecord, len(records))
+	byNetns := make(map[string]string)
+	for _, rec := range records {
+		if rec.Phase == PhaseDeleted {
+			continue
+		}
+		byName[rec.Name] = rec
+		if rec.Netns != "" {
+			byNetns[rec.Netns] = rec.Name
+		}
+	}
+
+	// sudo and the drafter binary it runs both show up; only the outermost
+	// process of each is adopted, which is also the one the API started
+	byPID := make(map[int]*drafterProcess, len(procs))
+	for _, proc := range procs {
+		byPID[proc.PID] = proc
+	}
+	owned := func(proc *drafterProcess) bool {
+		parent, ok := byPID[proc.PPID]
+		if !ok {
+			return false
+		}
+		// firecracker belongs to the peer or snapshotter above it
+		return parent.Component == proc.Component || proc.Component == "firecracker"
+	}
+
+	// Peers and snapshotters name their VM in their device paths, and give
+	// away its netns so forwarders can be matched too
+	vms := make(map[*drafterProcess]string)
+	for _, proc := range procs {
+		if owned(proc) || (proc.Component != "peer" && proc.Component != "snapshotter") {
+			continue
+		}
+		name := devicesVM(api.config.DataRoot, argValue(proc.Args, "--devices"))
+		if name == "" {
+			log.Printf("Reconcile: cannot tell which VM %s (pid %d) belongs to", proc.Component, proc.PID)
+			continue
+		}
+		vms[proc] = name
+		if netns := argValue(proc.Args, "--netns"); netns != "" {
+			if _, ok := byNetns[netns]; !ok {
+				byNetns[netns] = name
+			}
+		}
+	}
+	for _, proc := range procs {
+		if owned(proc) || proc.Component != "forwarder" {
+			continue
+		}
+		for _, forward := range parsePortForwards(argValue(proc.Args, "--port-forwards")) {
+			if name, ok := byNetns[forward.Netns]; ok {
+				vms[proc] = name
+				break
+			}
+		}
+		if _, ok := vms[proc]; !ok {
+			log.Printf("Reconcile: cannot tell which VM forwarder (pid %d) belongs to", proc.PID)
+		}
+	}
+
+	adopted := make(map[string]map[string]bool)
+	adoptedBlueprints := make(map[string]bool)
+	for _, proc := range procs {
+		if owned(proc) {
+			continue
+		}
+		switch proc.Component {
+		case "nat":
+			api.adopt(proc, "", filepath.Join(api.config.LogRoot, "nat.log"))
+			continue
+		case "firecracker":
+			log.Printf("Reconcile: firecracker (pid %d) has no drafter process above it", proc.PID)
+			continue
+		}
+
+		name, ok := vms[proc]
+		if !ok {
+			continue
+		}
+		if bpName, ok := ownerBlueprint(name); ok {
+			if api.adoptBlueprintSnapshotter(proc, bpName) {
+				adoptedBlueprints[bpName] = true
+			}
+			continue
+		}
+		rec, ok := byName[name]
+		if !ok {
+			rec, err = api.registerOrphan(name, vms)
+			if err != nil {
+				log.Printf("Reconcile: not adopting %s of VM %s: %v", proc.Component, name, err)
+				continue
+			}
+			byName[name] = rec
+		}
+
+		if err := api.recordAdoptedResources(rec, proc); err != nil {
+			log.Printf("Reconcile: error recording resources of VM %s: %v", name, err)
+		}
+		logPath := ""
+		if rec.LogsPath != "" {
+			logPath = filepath.Join(rec.LogsPath, proc.Component+".log")
+		}
+		if api.adopt(proc, name, logPath) {
+			if adopted[name] == nil {
+				adopted[name] = make(map[string]bool)
+			}
+			adopted[name][proc.Component] = true
+		}
+	}
+
+	for _, rec := range byName {
+		api.reconcileRecord(rec, adopted[rec.Name])
+	}
+	if err := api.reconcileBlueprints(adoptedBlueprints); err != nil {
+		return err
+	}
+	return api.reconcileWorkloads()
+}
+
+func (api *DrafterAPI) adopt(proc *drafterProcess, vm, logPath string) bool {
+	if _, err := api.supervisor.Adopt(ProcessSpec{
+		VM:        vm,
+		Component: proc.Component,
+		Args:      proc.Args,
+		LogPath:   logPath,
+		Restart:   api.config.restartPolicy(proc.Component),
+	}, proc.PID, proc.StartedAt); err != nil {
+		log.Printf("Reconcile: error adopting %s (pid %d): %v", proc.Component, proc.PID, err)
+		return false
+	}
+	return true
+}
+
+// registerOrphan creates a record for a VM that has processes and an
+// instance directory on disk but no live record in the registry. A deleted
+// record of the same name keeps its history and labels.
+func (api *DrafterAPI) registerOrphan(name string, vms map[*drafterProcess]string) (*VMRecord, error) {
+	rec := &VMRecord{Name: name, Config: VMConfig{Name: name}}
+	api.config.setVMPaths(rec)
+	if _, err := os.Stat(rec.BaseDir); err != nil {
+		return nil, fmt.Errorf("no record and no VM directory: %v", err)
+	}
+
+	phase := PhaseFailed
+	for proc, vm := range vms {
+		if vm != name {
+			continue
+		}
+		if proc.Component == "peer" {
+			phase = PhaseRunning
+		} else if proc.Component == "snapshotter" && phase != PhaseRunning {
+			phase = PhaseSnapshotting
+		}
+	}
+
+	if err := api.registry.Adopt(rec, phase, "adopted from running processes after API restart"); err != nil {
+		return nil, err
+	}
+	log.Printf("Reconcile: registered VM %s found on disk as %s", name, phase)
+	return rec, nil
+}
+
+// recordAdoptedResources fills in the netns, ports and logs path a process is
+// using
+func (api *DrafterAPI) recordAdoptedResources(rec *VMRecord, proc *drafterProcess) error {
+	updated, err := api.registry.Update(rec.Name, func(r *VMRecord) error {
+		// Restarted processes need a file to write to
+		if r.LogsPath == "" {
+			logManager, err := api.setupLogging(r.Name)
+			if err != nil {
+				return err
+			}
+			r.LogsPath = logManager.baseDir
+		}
+		if r.Ports == nil {
+			r.Ports = make(map[string]int)
+		}
+		switch proc.Component {
+		case "peer", "snapshotter":
+			if netns := argValue(proc.Args, "--netns"); netns != "" && r.Netns == "" {
+				r.Netns = netns
+			}
+			if port := addrPort(argValue(proc.Args, "--laddr")); port != 0 && proc.Component == "peer" {
+				r.Ports[PortPeer] = port
+			}
+		case "forwarder":
+			for _, forward := range parsePortForwards(argValue(proc.Args, "--port-forwards")) {
+				if port := addrPort(forward.ExternalAddr); port != 0 {
+					r.Ports[PortForward] = port
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		*rec = *updated
+	}
+	return err
+}
+
+// reconcileRecord fails a VM whose phase needs a process that is not running
+func (api *DrafterAPI) reconcileRecord(rec *VMRecord, adopted map[string]bool) {
+	var cause error
+	switch rec.Phase {
+	case PhaseCreating, PhaseStarting, PhaseMigratingIn:
+		cause = errors.New("interrupted by API restart")
+	case PhaseSnapshotting:
+		if !adopted["snapshotter"] {
+			cause = errors.New("snapshotter was not running after API restart")
+		}
+	case PhaseRunning, PhaseMigratingOut:
+		if !adopted["peer"] {
+			cause = errors.New("no live peer process after API restart")
+		}
+	}
+
+	updated, err := api.registry.Update(rec.Name, func(r *VMRecord) error {
+		// Forget processes that died while the API was down
+		for component := range r.PIDs {
+			if !adopted[component] {
+				delete(r.PIDs, component)
+			}
+		}
+		if cause != nil {
+			return r.transition(PhaseFailed, cause)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Reconcile: error updating VM %s: %v", rec.Name, err)
+		return
+	}
+
+	if cause == nil {
+		if len(adopted) > 0 {
+			log.Printf("Reconcile: adopted %d processes of VM %s", len(adopted), rec.Name)
+		}
+		if adopted["peer"] {
+			go api.watchMigrations(rec.Name)
+		}
+		return
+	}
+	log.Printf("Reconcile: marked VM %s as failed: %v", rec.Name, cause)
+
+	// A failed VM gives back its netns and ports, once whatever is left of it
+	// has been stopped
+	if _, err := api.stopVMProcesses(updated, api.config.StopGracePeriod); err != nil {
+		log.Printf("Reconcile: error stopping VM %s: %v", rec.Name, err)
+		return
+	}
+	if err := api.netns.Release(rec.Name); err != nil {
+		log.Printf("Reconcile: error releasing netns of VM %s: %v", rec.Name, err)
+	}
+	if err := api.ports.Release(rec.Name); err != nil {
+		log.Printf("Reconcile: error releasing ports of VM %s: %v", rec.Name, err)
+	}
+}
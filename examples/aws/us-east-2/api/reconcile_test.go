@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevicesVM(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DataRoot = "/srv/drafter"
+	vm := &VMRecord{Name: "vm-1"}
+	cfg.setVMPaths(vm)
+	bp := &Blueprint{Name: "base"}
+	cfg.setBlueprintPaths(bp)
+
+	mustJSON := func(devices string, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return devices
+	}
+
+	// A VM created from a blueprint reads its base from the blueprint
+	clone := &VMRecord{Name: "vm-2"}
+	cfg.setVMPaths(clone)
+	clone.PackageDir = bp.PackageDir
+
+	tests := []struct {
+		name    string
+		devices string
+		want    string
+	}{
+		{"vm snapshotter", mustJSON(snapshotterDevicesJSON(vm.BlueprintDir, vm.PackageDir)), "vm-1"},
+		{"vm peer", mustJSON(peerDevicesJSON(vm)), "vm-1"},
+		{"peer of a blueprint's vm", mustJSON(peerDevicesJSON(clone)), "vm-2"},
+		{"blueprint snapshotter", mustJSON(snapshotterDevicesJSON(bp.BlueprintDir, bp.PackageDir)), blueprintOwner("base")},
+		{"outside the data root", `[{"name":"state","output":"/tmp/state.bin"}]`, ""},
+		{"blueprints directory itself", `[{"name":"state","output":"` + filepath.Join(cfg.DataRoot, blueprintsKey) + `"}]`, ""},
+		{"default data root", `[{"name":"state","output":"` + defaultDataRoot + `/vm-1/instance/state/state.bin"}]`, ""},
+		{"invalid json", `not json`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := devicesVM(cfg.DataRoot, tt.devices); got != tt.want {
+				t.Errorf("devicesVM() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnerBlueprint(t *testing.T) {
+	if name, ok := ownerBlueprint(blueprintOwner("base")); !ok || name != "base" {
+		t.Errorf("ownerBlueprint(blueprintOwner(base)) = %q, %v", name, ok)
+	}
+	if name, ok := ownerBlueprint("vm-1"); ok {
+		t.Errorf("ownerBlueprint(vm-1) = %q, want no blueprint", name)
+	}
+}
+
+func TestRegistryAdopt(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	// A VM deleted before the restart keeps its labels and history
+	gone := &VMRecord{Name: "gone", Config: VMConfig{Name: "gone", Labels: map[string]string{"tier": "web"}}}
+	if _, err := reg.Replace(gone, PhaseCreating); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Transition("gone", PhaseDeleted, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Adopt(&VMRecord{Name: "gone", Config: VMConfig{Name: "gone"}}, PhaseRunning, "adopted"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := reg.Get("gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhaseRunning || rec.Config.Labels["tier"] != "web" {
+		t.Errorf("adopted record is %s with labels %v, want running with the old labels", rec.Phase, rec.Config.Labels)
+	}
+	if n := len(rec.Transitions); n != 3 {
+		t.Fatalf("history has %d entries, want 3", n)
+	}
+	if last := rec.Transitions[2]; last.From != PhaseDeleted || last.To != PhaseRunning || last.Cause != "adopted" {
+		t.Errorf("last transition = %+v, want the adoption", last)
+	}
+
+	// A VM with a live record is never adopted over
+	if err := reg.Adopt(&VMRecord{Name: "gone"}, PhaseFailed, "adopted"); !errors.Is(err, ErrVMExists) {
+		t.Errorf("Adopt() over a running VM = %v, want ErrVMExists", err)
+	}
+}
+
+func TestReconcileRecord(t *testing.T) {
+	reg, err := OpenRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+	api := &DrafterAPI{
+		config:     DefaultConfig(),
+		registry:   reg,
+		netns:      NewNetnsAllocator(reg, "ark", 4),
+		ports:      NewPortAllocator(reg),
+		supervisor: NewSupervisor(),
+	}
+
+	records := map[string]*VMRecord{
+		"running":      {Phase: PhaseRunning, Netns: "ark0", Ports: map[string]int{PortPeer: 1337, PortForward: 3333}, PIDs: map[string]int{"peer": 1 << 30}},
+		"snapshotting": {Phase: PhaseSnapshotting, Netns: "ark1", PIDs: map[string]int{"snapshotter": 1 << 30}},
+		"stopped":      {Phase: PhaseStopped},
+	}
+	for name, rec := range records {
+		rec.Name = name
+		if err := reg.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The peer died while the API was down, the snapshotter was adopted
+	for name, rec := range records {
+		var adopted map[string]bool
+		if name == "snapshotting" {
+			adopted = map[string]bool{"snapshotter": true}
+		}
+		api.reconcileRecord(rec, adopted)
+	}
+
+	rec, err := reg.Get("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhaseFailed || rec.Netns != "" || len(rec.Ports) != 0 || len(rec.PIDs) != 0 {
+		t.Errorf("VM without its peer is %s with netns %q, ports %v and pids %v, want failed with everything released", rec.Phase, rec.Netns, rec.Ports, rec.PIDs)
+	}
+	if rec, err := reg.Get("snapshotting"); err != nil || rec.Phase != PhaseSnapshotting || rec.Netns != "ark1" {
+		t.Errorf("VM with an adopted snapshotter = %+v, %v, want it untouched", rec, err)
+	}
+	if rec, err := reg.Get("stopped"); err != nil || rec.Phase != PhaseStopped {
+		t.Errorf("stopped VM = %+v, %v, want it untouched", rec, err)
+	}
+}
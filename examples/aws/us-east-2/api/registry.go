@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultRegistryPath keeps the registry next to the log root, which is
+// /home/ec2-user/drafter-api/registry.db with the default roots
+func defaultRegistryPath(logRoot string) string {
+	return filepath.Join(filepath.Dir(logRoot), "registry.db")
+}
+
+// VM phases stored in the registry, see phaseTransitions for how a VM moves
+// between them
+const (
+	PhaseCreating     = "creating"
+	PhaseSnapshotting = "snapshotting"
+	PhaseReady        = "ready"
+	PhaseStarting     = "starting"
+	PhaseRunning      = "running"
+	PhaseMigratingOut = "migrating-out"
+	PhaseMigratingIn  = "migrating-in"
+	PhaseStopped      = "stopped"
+	PhaseFailed       = "failed"
+	PhaseDeleted      = "deleted"
+)
+
+var (
+	ErrVMNotFound   = errors.New("vm not found")
+	ErrVMExists     = errors.New("vm already exists")
+	ErrVMNotDeleted = errors.New("vm is not deleted")
+)
+
+var vmsBucket = []byte("vms")
+
+// VMRecord is everything the API knows about a single VM
+type VMRecord struct {
+	Name   string   `json:"name"`
+	Config VMConfig `json:"config"`
+	Phase  string   `json:"phase"`
+	Error  string   `json:"error,omitempty"`
+
+	// Source is the VM whose package a clone runs from
+	Source string `json:"source,omitempty"`
+
+	BaseDir      string `json:"base_dir"`
+	BlueprintDir string `json:"blueprint_dir"`
+	PackageDir   string `json:"package_dir"`
+	InstanceDir  string `json:"instance_dir"`
+	OverlayDir   string `json:"overlay_dir"`
+	StateDir     string `json:"state_dir"`
+	LogsPath     string `json:"logs_path,omitempty"`
+
+	Netns string         `json:"netns,omitempty"`
+	Ports map[string]int `json:"ports,omitempty"`
+	PIDs  map[string]int `json:"pids,omitempty"`
+
+	// PackageConfig is the config.json the snapshotter wrote into the package
+	PackageConfig map[string]interface{} `json:"package_config,omitempty"`
+
+	Transitions []PhaseTransition `json:"transitions,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registry persists VM records in an embedded bolt database
+type Registry struct {
+	db *bolt.DB
+}
+
+func OpenRegistry(path string) (*Registry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create registry directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry %s: %v", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{vmsBucket, jobsBucket, idempotencyBucket, blueprintsBucket, workloadsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize registry: %v", err)
+	}
+
+	return &Registry{db: db}, nil
+}
+
+func (r *Registry) Close() error {
+	return r.db.Close()
+}
+
+func getRecord(b *bolt.Bucket, name string) (*VMRecord, error) {
+	data := b.Get([]byte(name))
+	if data == nil {
+		return nil, ErrVMNotFound
+	}
+
+	var rec VMRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to decode record for %s: %v", name, err)
+	}
+	return &rec, nil
+}
+
+func putRecord(b *bolt.Bucket, rec *VMRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode record for %s: %v", rec.Name, err)
+	}
+	return b.Put([]byte(rec.Name), data)
+}
+
+func (r *Registry) Get(name string) (*VMRecord, error) {
+	var rec *VMRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = getRecord(tx.Bucket(vmsBucket), name)
+		return err
+	})
+	return rec, err
+}
+
+// Create stores a new record, failing if the name is already taken
+func (r *Registry) Create(rec *VMRecord) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+		if b.Get([]byte(rec.Name)) != nil {
+			return ErrVMExists
+		}
+
+		now := time.Now().UTC()
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+		return putRecord(b, rec)
+	})
+}
+
+// Put stores a record, replacing any existing one with the same name
+func (r *Registry) Put(rec *VMRecord) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UTC()
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+		rec.UpdatedAt = now
+		return putRecord(tx.Bucket(vmsBucket), rec)
+	})
+}
+
+// Update applies fn to the stored record inside a single transaction
+func (r *Registry) Update(name string, fn func(rec *VMRecord) error) (*VMRecord, error) {
+	var rec *VMRecord
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		var err error
+		rec, err = getRecord(b, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+
+		rec.UpdatedAt = time.Now().UTC()
+		return putRecord(b, rec)
+	})
+	return rec, err
+}
+
+// UpdateWithOthers is like Update but also hands fn every other record, so
+// shared resources can be allocated without racing concurrent requests
+func (r *Registry) UpdateWithOthers(name string, fn func(rec *VMRecord, others []*VMRecord) error) (*VMRecord, error) {
+	var rec *VMRecord
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		var others []*VMRecord
+		if err := b.ForEach(func(k, v []byte) error {
+			if string(k) == name {
+				return nil
+			}
+			var other VMRecord
+			if err := json.Unmarshal(v, &other); err != nil {
+				return fmt.Errorf("failed to decode record for %s: %v", k, err)
+			}
+			others = append(others, &other)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		var err error
+		rec, err = getRecord(b, name)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec, others); err != nil {
+			return err
+		}
+
+		rec.UpdatedAt = time.Now().UTC()
+		return putRecord(b, rec)
+	})
+	return rec, err
+}
+
+func (r *Registry) List() ([]*VMRecord, error) {
+	var recs []*VMRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(vmsBucket).ForEach(func(k, v []byte) error {
+			var rec VMRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("failed to decode record for %s: %v", k, err)
+			}
+			recs = append(recs, &rec)
+			return nil
+		})
+	})
+	return recs, err
+}
+
+// Transition moves a record to a new phase, recording an optional error, and
+// applies fn to it in the same transaction. It fails with a TransitionError
+// if the move is not allowed.
+func (r *Registry) Transition(name, phase string, cause error, fn func(rec *VMRecord) error) (*VMRecord, error) {
+	return r.Update(name, func(rec *VMRecord) error {
+		if err := rec.transition(phase, cause); err != nil {
+			return err
+		}
+		if fn != nil {
+			return fn(rec)
+		}
+		return nil
+	})
+}
+
+// Replace stores rec in place of any record with the same name, moving it
+// from the existing record's phase to phase. The phase history is kept. It
+// returns the record it replaced, or nil.
+func (r *Registry) Replace(rec *VMRecord, phase string) (*VMRecord, error) {
+	var previous *VMRecord
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		rec.Phase = ""
+		rec.Transitions = nil
+		existing, err := getRecord(b, rec.Name)
+		if err == nil {
+			previous = existing
+			rec.Phase = existing.Phase
+			rec.Transitions = existing.Transitions
+		} else if !errors.Is(err, ErrVMNotFound) {
+			return err
+		}
+		if err := rec.transition(phase, nil); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+		rec.UpdatedAt = now
+		return putRecord(b, rec)
+	})
+	return previous, err
+}
+
+// Adopt stores rec in phase for a VM found running without a live record.
+// If a deleted record of the same name exists, its config, history and
+// creation time are kept. Adoption is the one way into a phase that skips the
+// state machine, so the move is recorded by hand.
+func (r *Registry) Adopt(rec *VMRecord, phase, cause string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		from := ""
+		existing, err := getRecord(b, rec.Name)
+		if err == nil {
+			if existing.Phase != PhaseDeleted {
+				return ErrVMExists
+			}
+			from = existing.Phase
+			rec.Config = existing.Config
+			rec.Source = existing.Source
+			rec.BlueprintDir = existing.BlueprintDir
+			rec.PackageDir = existing.PackageDir
+			rec.PackageConfig = existing.PackageConfig
+			rec.Transitions = existing.Transitions
+			rec.CreatedAt = existing.CreatedAt
+		} else if !errors.Is(err, ErrVMNotFound) {
+			return err
+		}
+
+		now := time.Now().UTC()
+		rec.Phase = phase
+		rec.Error = ""
+		rec.Transitions = append(rec.Transitions, PhaseTransition{From: from, To: phase, At: now, Cause: cause})
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+		rec.UpdatedAt = now
+		return putRecord(b, rec)
+	})
+}
+
+// Restore undoes a request that moved a VM to phase but could not queue its
+// job: the record goes back to previous, or is removed if there was none.
+// A record that has left phase since is left alone.
+func (r *Registry) Restore(name, phase string, previous *VMRecord) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		rec, err := getRecord(b, name)
+		if err != nil {
+			return err
+		}
+		if rec.Phase != phase {
+			return nil
+		}
+		if previous == nil {
+			return b.Delete([]byte(name))
+		}
+		log.Printf("VM %s: %s -> %s, its job could not be queued", name, phase, previous.Phase)
+		return putRecord(b, previous)
+	})
+}
+
+// Purge removes the record of a deleted VM, and with it the VM's history
+func (r *Registry) Purge(name string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(vmsBucket)
+
+		rec, err := getRecord(b, name)
+		if err != nil {
+			return err
+		}
+		if rec.Phase != PhaseDeleted {
+			return ErrVMNotDeleted
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// restoreVM puts a VM back after its job could not be queued, so a full
+// queue does not leave a healthy VM failed
+func (api *DrafterAPI) restoreVM(name, phase string, previous *VMRecord) {
+	if err := api.registry.Restore(name, phase, previous); err != nil {
+		log.Printf("Error restoring VM %s: %v", name, err)
+	}
+}
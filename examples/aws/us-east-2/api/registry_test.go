@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+	reg, err := OpenRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reg.Get("vm-1"); !errors.Is(err, ErrVMNotFound) {
+		t.Errorf("Get() of an unknown VM = %v, want ErrVMNotFound", err)
+	}
+	if _, err := reg.Update("vm-1", func(rec *VMRecord) error { return nil }); !errors.Is(err, ErrVMNotFound) {
+		t.Errorf("Update() of an unknown VM = %v, want ErrVMNotFound", err)
+	}
+
+	for _, name := range []string{"vm-1", "vm-2"} {
+		if err := reg.Put(&VMRecord{Name: name, Phase: PhaseCreating, Config: VMConfig{Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created, err := reg.Get("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.CreatedAt.IsZero() || created.UpdatedAt.IsZero() {
+		t.Errorf("stored record has no timestamps: %+v", created)
+	}
+
+	errAbort := errors.New("abort")
+	if _, err := reg.Update("vm-1", func(rec *VMRecord) error {
+		rec.Netns = "ark0"
+		return errAbort
+	}); !errors.Is(err, errAbort) {
+		t.Fatalf("Update() = %v, want the error of fn", err)
+	}
+	if rec, _ := reg.Get("vm-1"); rec.Netns != "" {
+		t.Error("a failed Update() was stored")
+	}
+	if _, err := reg.Update("vm-1", func(rec *VMRecord) error {
+		rec.Netns = "ark0"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records outlive the process
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if reg, err = OpenRegistry(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	rec, err := reg.Get("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Netns != "ark0" || rec.Phase != PhaseCreating || !rec.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("reopened record = %+v, want the update and the original creation time", rec)
+	}
+
+	recs, err := reg.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rec := range recs {
+		names = append(names, rec.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "vm-1" || names[1] != "vm-2" {
+		t.Errorf("List() = %v, want vm-1 and vm-2", names)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often a create job reports on a running snapshotter
+const snapshotProgressInterval = 5 * time.Second
+
+// Wait waits up to timeout for a process to exit for good. It returns the
+// process's last status and whether it has exited.
+func (s *Supervisor) Wait(vm, component string, timeout time.Duration) (ProcessStatus, bool) {
+	s.mu.Lock()
+	p, ok := s.procs[processKey(vm, component)]
+	s.mu.Unlock()
+	if !ok {
+		return ProcessStatus{VM: vm, Component: component, Error: "process is not supervised"}, true
+	}
+
+	exited := waitDone(p.done, timeout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.snapshot(), exited
+}
+
+// waitSnapshotter waits for a VM's snapshotter to exit, stopping it if it
+// runs for longer than the snapshot timeout
+func (api *DrafterAPI) waitSnapshotter(run *JobRun, name string) (ProcessStatus, error) {
+	start := time.Now()
+	for {
+		status, exited := api.supervisor.Wait(name, "snapshotter", snapshotProgressInterval)
+		if exited {
+			return status, nil
+		}
+
+		if time.Since(start) >= api.config.SnapshotTimeout {
+			result, _ := api.supervisor.Stop(name, "snapshotter", api.config.StopGracePeriod)
+			return status, fmt.Errorf("snapshotter still running after %s, stopped it (%s): %s",
+				api.config.SnapshotTimeout, result.Outcome, strings.TrimSpace(status.StderrTail))
+		}
+		run.Progress(0, fmt.Sprintf("snapshotter running for %s", time.Since(start).Round(time.Second)))
+	}
+}
+
+// runSnapshotter snapshots the devices in blueprintDir into packageDir and
+// waits for the snapshotter to exit. owner is the VM or blueprint the
+// snapshotter is supervised under.
+func (api *DrafterAPI) runSnapshotter(run *JobRun, owner, netns string, opts buildOptions, blueprintDir, packageDir string, logManager *LogManager) (ProcessStatus, error) {
+	snapshotLogger, err := logManager.GetLogger("snapshotter")
+	if err != nil {
+		log.Printf("Error creating snapshotter logger: %v", err)
+		return ProcessStatus{}, fmt.Errorf("failed to create snapshotter logger: %v", err)
+	}
+
+	devices, err := snapshotterDevicesJSON(blueprintDir, packageDir)
+	if err != nil {
+		return ProcessStatus{}, fmt.Errorf("invalid snapshotter devices: %v", err)
+	}
+
+	snapshotLogger.Printf("Starting snapshotter in netns %s", netns)
+	args := []string{"sudo", api.config.Artifacts.binary("drafter-snapshotter"),
+		"--netns", netns,
+		"--devices", devices}
+	args = append(args, opts.snapshotterArgs()...)
+	if _, err := api.startProcess(owner, "snapshotter", logManager, args...); err != nil {
+		snapshotLogger.Printf("Error starting snapshotter: %v", err)
+		return ProcessStatus{}, fmt.Errorf("failed to start snapshotter: %v", err)
+	}
+
+	snapshotLogger.Printf("Waiting up to %s for snapshotter to finish", api.config.SnapshotTimeout)
+	status, err := api.waitSnapshotter(run, owner)
+	if err != nil {
+		snapshotLogger.Printf("Error waiting for snapshotter: %v", err)
+		return status, err
+	}
+	return status, nil
+}
+
+// logSnapshotError records why a snapshot was rejected in the snapshotter log
+func logSnapshotError(logManager *LogManager, err error) {
+	if snapshotLogger, logErr := logManager.GetLogger("snapshotter"); logErr == nil {
+		snapshotLogger.Printf("Snapshot failed: %v", err)
+	}
+}
+
+// verifyPackage checks that the snapshotter wrote every device of the
+// package and returns the file sizes and the parsed package config
+func verifyPackage(packageDir string) (map[string]int64, map[string]interface{}, error) {
+	sizes := make(map[string]int64, len(packageFiles))
+	var problems []string
+	for _, f := range packageFiles {
+		path := filepath.Join(packageDir, f.File)
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			problems = append(problems, fmt.Sprintf("%s is missing", f.File))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", f.File, err))
+		case info.Size() == 0:
+			problems = append(problems, fmt.Sprintf("%s is empty", f.File))
+		default:
+			sizes[f.File] = info.Size()
+		}
+	}
+	if len(problems) > 0 {
+		return sizes, nil, errors.New(strings.Join(problems, ", "))
+	}
+
+	data, err := os.ReadFile(filepath.Join(packageDir, "config.json"))
+	if err != nil {
+		return sizes, nil, fmt.Errorf("failed to read config.json: %v", err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return sizes, nil, fmt.Errorf("config.json is not valid: %v", err)
+	}
+	return sizes, config, nil
+}
+
+// checkSnapshot checks how a snapshotter exited and what it wrote to
+// packageDir, then records the package's CPU template next to it. The error
+// carries the tail of the snapshotter's output.
+func checkSnapshot(packageDir, cpuTemplate string, status ProcessStatus) (map[string]int64, map[string]interface{}, error) {
+	switch {
+	case status.Adopted && status.ExitCode == nil:
+		// The exit status of an adopted snapshotter is lost, so its package
+		// has to speak for it
+	case status.ExitCode == nil || *status.ExitCode != 0 || status.Signal != "":
+		return nil, nil, fmt.Errorf("snapshotter failed: %s", exitDescription(status))
+	}
+
+	sizes, config, err := verifyPackage(packageDir)
+	if err != nil {
+		output := strings.TrimSpace(status.StderrTail)
+		if output == "" {
+			output = "no output"
+		}
+		return sizes, nil, fmt.Errorf("snapshot package in %s is incomplete: %v; snapshotter output: %s", packageDir, err, output)
+	}
+	if err := writePackageCPUTemplate(packageDir, cpuTemplate); err != nil {
+		return sizes, nil, err
+	}
+	return sizes, config, nil
+}
+
+// finishSnapshot checks the VM's package and moves the VM to ready
+func (api *DrafterAPI) finishSnapshot(name string, status ProcessStatus) (map[string]int64, error) {
+	rec, err := api.registry.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM record: %v", err)
+	}
+
+	sizes, config, err := checkSnapshot(rec.PackageDir, rec.Config.cpuTemplate(), status)
+	if err != nil {
+		return sizes, err
+	}
+
+	if _, err := api.registry.Transition(name, PhaseReady, nil, func(rec *VMRecord) error {
+		rec.PackageConfig = config
+		delete(rec.PIDs, "snapshotter")
+		return nil
+	}); err != nil {
+		return sizes, fmt.Errorf("failed to update VM record: %v", err)
+	}
+
+	// A VM that is not running does not need its netns
+	if err := api.netns.Release(name); err != nil {
+		log.Printf("Error releasing netns of VM %s: %v", name, err)
+	}
+	return sizes, nil
+}
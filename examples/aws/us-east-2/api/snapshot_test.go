@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePackage writes a package with every file, leaving out the missing
+// ones
+func writePackage(t *testing.T, config string, missing ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range packageFiles {
+		content := "data"
+		if f.File == "config.json" {
+			content = config
+		}
+		skip := false
+		for _, name := range missing {
+			skip = skip || name == f.File
+		}
+		if skip {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.File), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestVerifyPackage(t *testing.T) {
+	sizes, config, err := verifyPackage(writePackage(t, `{"agentVSockPort": 26}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != len(packageFiles) || sizes["state.bin"] != 4 {
+		t.Errorf("sizes = %v, want every file", sizes)
+	}
+	if config["agentVSockPort"] != float64(26) {
+		t.Errorf("config = %v, want the parsed config.json", config)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		wantErr string
+	}{
+		{"missing memory", writePackage(t, `{}`, "memory.bin"), "memory.bin is missing"},
+		{"empty config", writePackage(t, ``), "config.json is empty"},
+		{"invalid config", writePackage(t, `{"agentVSockPort":`), "config.json is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := verifyPackage(tt.dir); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verifyPackage() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSnapshotFailures(t *testing.T) {
+	clean, failed := 0, 1
+	tests := []struct {
+		name    string
+		dir     string
+		status  ProcessStatus
+		wantErr string
+	}{
+		{"exit code", writePackage(t, `{}`), ProcessStatus{ExitCode: &failed, StderrTail: "kvm not available"}, "snapshotter failed: exit code 1: kvm not available"},
+		{"signal", writePackage(t, `{}`), ProcessStatus{ExitCode: &failed, Signal: "killed"}, "snapshotter failed: killed by killed"},
+		{"incomplete package", writePackage(t, `{}`, "state.bin"), ProcessStatus{ExitCode: &clean}, "state.bin is missing; snapshotter output: no output"},
+		// An adopted snapshotter's exit code is lost, its package is checked
+		{"adopted", writePackage(t, `{}`, "vmlinux"), ProcessStatus{Adopted: true}, "vmlinux is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := checkSnapshot(tt.dir, "None", tt.status); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkSnapshot() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
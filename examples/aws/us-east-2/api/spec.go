@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultMemoryMiB = 1024
+	minMemoryMiB     = 128
+)
+
+// PackageSpec is what a snapshot package is built from. Sizes are numbers
+// with an optional K, M, G or T suffix (binary units) and plain numbers are
+// MiB.
+type PackageSpec struct {
+	Memory    string `json:"memory"`
+	CPUs      int    `json:"cpus"`
+	DiskSize  string `json:"disk_size"`
+	ImagePath string `json:"image_path"`
+	// CPUTemplate is the Firecracker CPU template to snapshot with, by
+	// default the one for the host's CPU vendor
+	CPUTemplate string `json:"cpu_template,omitempty"`
+
+	// Workload is the OCI package to run instead of Valkey
+	Workload *Workload `json:"workload,omitempty"`
+}
+
+// buildOptions is a validated PackageSpec
+type buildOptions struct {
+	MemoryMiB int
+	// CPUs is zero to leave the snapshotter's default
+	CPUs int
+	// DiskSize is zero to keep the disks as they come
+	DiskSize    int64
+	CPUTemplate string
+	Workload    Workload
+}
+
+var sizePattern = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(I?B)?$`)
+
+// parseSize parses a size such as "512M" or "2GiB" into bytes
+func parseSize(value string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional K, M, G or T suffix", value)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", value, err)
+	}
+
+	shift := map[string]uint{"K": 10, "": 20, "M": 20, "G": 30, "T": 40}[m[2]]
+	if m[2] == "" && m[3] != "" {
+		// A bare "B" means bytes
+		shift = 0
+	}
+	if n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return n << shift, nil
+}
+
+// Resolve validates the spec, rejecting anything the API cannot honor. A spec
+// that names no workload runs defaultWorkload.
+func (s PackageSpec) Resolve(defaultWorkload Workload) (buildOptions, error) {
+	opts := buildOptions{MemoryMiB: defaultMemoryMiB, CPUs: s.CPUs}
+	var problems []string
+
+	if s.Memory != "" {
+		size, err := parseSize(s.Memory)
+		switch {
+		case err != nil:
+			problems = append(problems, "memory: "+err.Error())
+		case size%(1<<20) != 0:
+			problems = append(problems, fmt.Sprintf("memory %q is not a whole number of MiB", s.Memory))
+		case size>>20 < minMemoryMiB:
+			problems = append(problems, fmt.Sprintf("memory %q is less than the minimum of %d MiB", s.Memory, minMemoryMiB))
+		default:
+			opts.MemoryMiB = int(size >> 20)
+		}
+	}
+
+	if s.CPUs < 0 || s.CPUs > runtime.NumCPU() {
+		problems = append(problems, fmt.Sprintf("cpus must be between 1 and the host's %d CPUs, got %d", runtime.NumCPU(), s.CPUs))
+	}
+
+	if s.DiskSize != "" {
+		size, err := parseSize(s.DiskSize)
+		switch {
+		case err != nil:
+			problems = append(problems, "disk_size: "+err.Error())
+		case size == 0:
+			problems = append(problems, "disk_size must be positive")
+		default:
+			opts.DiskSize = size
+		}
+	}
+
+	template, err := resolveCPUTemplate(s.CPUTemplate)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	opts.CPUTemplate = template
+
+	workload, err := s.resolveWorkload(defaultWorkload)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	opts.Workload = workload
+
+	if len(problems) > 0 {
+		return opts, errors.New(strings.Join(problems, ", "))
+	}
+	return opts, nil
+}
+
+// mismatches lists the fields s sets to something other than what built was
+// built with
+func (s PackageSpec) mismatches(built PackageSpec, defaultWorkload Workload) ([]string, error) {
+	want, err := s.Resolve(defaultWorkload)
+	if err != nil {
+		return nil, err
+	}
+	// The package a blueprint was built from may be gone by now, which does
+	// not matter for the rest of its spec
+	have, _ := built.Resolve(defaultWorkload)
+	have.CPUTemplate = built.cpuTemplate()
+
+	var fields []string
+	if s.Memory != "" && want.MemoryMiB != have.MemoryMiB {
+		fields = append(fields, "memory")
+	}
+	if s.CPUs != 0 && want.CPUs != have.CPUs {
+		fields = append(fields, "cpus")
+	}
+	if s.DiskSize != "" && want.DiskSize != have.DiskSize {
+		fields = append(fields, "disk_size")
+	}
+	if s.CPUTemplate != "" && want.CPUTemplate != have.CPUTemplate {
+		fields = append(fields, "cpu_template")
+	}
+	if (s.Workload != nil || s.ImagePath != "") && want.Workload != have.Workload {
+		fields = append(fields, "workload")
+	}
+	return fields, nil
+}
+
+// cpuTemplate is the CPU template a package built from the spec was
+// snapshotted with
+func (s PackageSpec) cpuTemplate() string {
+	if s.CPUTemplate == "" {
+		return legacyCPUTemplate
+	}
+	return s.CPUTemplate
+}
+
+// checkLocalPackage checks that a package on disk can be read
+func checkLocalPackage(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q is not absolute", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a file", path)
+	}
+	return nil
+}
+
+// snapshotterArgs are the drafter-snapshotter flags the options set
+func (o buildOptions) snapshotterArgs() []string {
+	args := []string{"--cpu-template", o.CPUTemplate, "--memory-size", strconv.Itoa(o.MemoryMiB)}
+	if o.CPUs > 0 {
+		args = append(args, "--cpu-count", strconv.Itoa(o.CPUs))
+	}
+	return args
+}
+
+// growDisk grows an ext4 image to size bytes and resizes its filesystem to
+// fill it. Images are never shrunk.
+func growDisk(path string, size int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return fmt.Errorf("%s is already %d bytes, more than disk_size %d", filepath.Base(path), info.Size(), size)
+	}
+	if info.Size() == size {
+		return nil
+	}
+
+	// The images were extracted by root
+	if out, err := exec.Command("sudo", "truncate", "-s", strconv.FormatInt(size, 10), path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to grow %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	// e2fsck exits with 1 when it fixed something, which is fine
+	if out, err := exec.Command("sudo", "e2fsck", "-fy", path).CombinedOutput(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() > 1 {
+			return fmt.Errorf("failed to check %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if out, err := exec.Command("sudo", "resize2fs", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resize %s: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// growDisks applies disk_size to the disk and OCI images in blueprintDir
+func growDisks(run *JobRun, blueprintDir string, size int64) error {
+	run.Phase("resize")
+	files := []string{"rootfs.ext4", "oci.ext4"}
+	for i, file := range files {
+		if err := growDisk(filepath.Join(blueprintDir, file), size); err != nil {
+			return err
+		}
+		run.Progress(float64(i+1)/float64(len(files)), "resized "+file)
+	}
+	return nil
+}
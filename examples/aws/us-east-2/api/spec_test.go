@@ -0,0 +1,112 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"512", 512 << 20},
+		{"512M", 512 << 20},
+		{"512MB", 512 << 20},
+		{"512MiB", 512 << 20},
+		{"2g", 2 << 30},
+		{"2GiB", 2 << 30},
+		{"1T", 1 << 40},
+		{"64K", 64 << 10},
+		{"4096B", 4096},
+		{" 1 G ", 1 << 30},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if err != nil {
+			t.Errorf("parseSize(%q) returned %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	for _, value := range []string{"", "M", "-1G", "1.5G", "1P", "1GG", "lots", "8589934592T", "99999999999999999999"} {
+		if got, err := parseSize(value); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestPackageSpecResolve(t *testing.T) {
+	valkey := Workload{Name: "valkey", Package: "https://example.com/oci-valkey-x86_64.tar.zst", Port: defaultWorkloadPort}
+
+	tests := []struct {
+		name string
+		spec PackageSpec
+		want buildOptions
+	}{
+		{"defaults", PackageSpec{}, buildOptions{MemoryMiB: defaultMemoryMiB, Workload: valkey}},
+		{
+			"sizes",
+			PackageSpec{Memory: "2G", CPUs: 1, DiskSize: "10GiB"},
+			buildOptions{MemoryMiB: 2048, CPUs: 1, DiskSize: 10 << 30, Workload: valkey},
+		},
+		{"plain memory is MiB", PackageSpec{Memory: "512"}, buildOptions{MemoryMiB: 512, Workload: valkey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.Resolve(valkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The CPU template depends on the host and is tested on its own
+			got.CPUTemplate = ""
+			if got != tt.want {
+				t.Errorf("Resolve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackageSpecResolveInvalid(t *testing.T) {
+	valkey := Workload{Name: "valkey", Package: "https://example.com/oci-valkey-x86_64.tar.zst", Port: defaultWorkloadPort}
+
+	tests := []struct {
+		name    string
+		spec    PackageSpec
+		wantErr []string
+	}{
+		{"memory not a size", PackageSpec{Memory: "lots"}, []string{`memory: invalid size "lots"`}},
+		{"memory not whole MiB", PackageSpec{Memory: "1536K"}, []string{"not a whole number of MiB"}},
+		{"memory too small", PackageSpec{Memory: "64M"}, []string{"less than the minimum of 128 MiB"}},
+		{"negative cpus", PackageSpec{CPUs: -1}, []string{"cpus must be between 1 and"}},
+		{"more cpus than the host", PackageSpec{CPUs: runtime.NumCPU() + 1}, []string{"cpus must be between 1 and"}},
+		{"empty disk", PackageSpec{DiskSize: "0"}, []string{"disk_size must be positive"}},
+		{"unknown CPU template", PackageSpec{CPUTemplate: "T9"}, []string{`unknown CPU template "T9"`}},
+		{"missing package", PackageSpec{ImagePath: "/nonexistent/oci.tar.zst"}, []string{"workload.package"}},
+		{
+			"every problem at once",
+			PackageSpec{Memory: "64M", DiskSize: "huge", CPUs: -1},
+			[]string{"less than the minimum", "cpus must be", "disk_size: invalid size"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.spec.Resolve(valkey)
+			if err == nil {
+				t.Fatal("Resolve() accepted the spec")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Resolve() = %v, want an error containing %q", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to wait for a process to disappear after SIGKILL
+const killTimeout = 10 * time.Second
+
+// Outcomes reported for each component by a stop
+const (
+	StopNotRunning = "not-running"
+	StopTerminated = "terminated"
+	StopKilled     = "killed"
+	StopFailed     = "failed"
+)
+
+// stopOrder is the order a VM's components are stopped in: traffic first,
+// then the VM itself
+var stopOrder = []string{"forwarder", "peer", "snapshotter"}
+
+// StopResult reports how a single component was stopped
+type StopResult struct {
+	Component string `json:"component"`
+	PID       int    `json:"pid,omitempty"`
+	Outcome   string `json:"outcome"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+	Signal    string `json:"signal,omitempty"`
+	Duration  string `json:"duration"`
+	Error     string `json:"error,omitempty"`
+}
+
+// procStat returns the fields of /proc/<pid>/stat after the command name,
+// starting with the process state
+func procStat(pid int) []string {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil
+	}
+	// The command name may contain spaces, so parse after its closing paren
+	return strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+}
+
+// processAlive reports whether a process exists and has not exited. It reads
+// /proc rather than sending signal 0, so it answers the same for the root
+// processes sudo starts, which the API may not signal, and counts a zombie
+// as exited.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	fields := procStat(pid)
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+// descendants returns the PIDs of every process below pid
+func descendants(pid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fields := procStat(child)
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	var result []int
+	queue := []int{pid}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, child := range children[next] {
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+	return result
+}
+
+// killProcess and sudoKill send signals; tests replace them
+var (
+	killProcess = syscall.Kill
+	sudoKill    = func(sig syscall.Signal, pids []int) error {
+		args := []string{"-n", "kill", "-" + strconv.Itoa(int(sig)), "--"}
+		for _, pid := range pids {
+			args = append(args, strconv.Itoa(pid))
+		}
+		if out, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+)
+
+// signalTree signals a process, its process group and all of its
+// descendants. drafter commands run under sudo, which does not relay SIGKILL
+// and runs them as root, so whatever the API may not signal itself is
+// signalled through sudo kill.
+func signalTree(pid int, sig syscall.Signal) error {
+	targets := []int{pid}
+	if pgid, pgErr := syscall.Getpgid(pid); pgErr == nil && pgid == pid {
+		targets = append(targets, -pgid)
+	}
+	targets = append(targets, descendants(pid)...)
+
+	var err error
+	var denied []int
+	for i, target := range targets {
+		killErr := killProcess(target, sig)
+		if killErr == syscall.EPERM {
+			denied = append(denied, target)
+		} else if i == 0 && killErr != syscall.ESRCH {
+			err = killErr
+		}
+	}
+	if len(denied) > 0 {
+		// Some of the tree may have exited meanwhile, which sudo kill reports
+		// as well, so only fail if the process itself is still there
+		if sudoErr := sudoKill(sig, denied); sudoErr != nil && processAlive(pid) {
+			err = fmt.Errorf("sudo kill: %v", sudoErr)
+		}
+	}
+	return err
+}
+
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func waitDone(done chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return isDone(done)
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop stops a supervised process without restarting it. It sends SIGTERM,
+// waits up to grace for the process to exit and then sends SIGKILL. A zero
+// grace period kills the process straight away.
+func (s *Supervisor) Stop(vm, component string, grace time.Duration) (StopResult, bool) {
+	s.mu.Lock()
+	p, ok := s.procs[processKey(vm, component)]
+	if !ok {
+		s.mu.Unlock()
+		return StopResult{}, false
+	}
+	p.stopping = true
+	running := p.status.Running
+	pid := p.status.PID
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	s.mu.Unlock()
+
+	start := time.Now()
+	result := StopResult{Component: component, PID: pid}
+	if !running {
+		waitDone(p.done, killTimeout)
+		result.Outcome = StopNotRunning
+		result.Duration = time.Since(start).String()
+		return result, true
+	}
+
+	result.Outcome = StopTerminated
+	if grace > 0 {
+		log.Printf("Sending SIGTERM to %s (pid %d), grace period %s", processKey(vm, component), pid, grace)
+		if err := signalTree(pid, syscall.SIGTERM); err != nil {
+			log.Printf("Error sending SIGTERM to pid %d: %v", pid, err)
+		}
+	}
+	if !waitDone(p.done, grace) {
+		log.Printf("Sending SIGKILL to %s (pid %d)", processKey(vm, component), pid)
+		result.Outcome = StopKilled
+		if err := signalTree(pid, syscall.SIGKILL); err != nil {
+			log.Printf("Error sending SIGKILL to pid %d: %v", pid, err)
+		}
+		if !waitDone(p.done, killTimeout) {
+			result.Outcome = StopFailed
+			result.Error = fmt.Sprintf("process still running %s after SIGKILL", killTimeout)
+		}
+	}
+
+	if status, ok := s.Status(vm, component); ok {
+		result.ExitCode = status.ExitCode
+		result.Signal = status.Signal
+	}
+	result.Duration = time.Since(start).String()
+	return result, true
+}
+
+// stopPID stops a process the supervisor does not own, such as one left
+// behind by an earlier run of the API
+func stopPID(component string, pid int, grace time.Duration) (result StopResult) {
+	start := time.Now()
+	result = StopResult{Component: component, PID: pid}
+	defer func() { result.Duration = time.Since(start).String() }()
+
+	if !processAlive(pid) {
+		result.Outcome = StopNotRunning
+		return result
+	}
+
+	result.Outcome = StopTerminated
+	if grace > 0 {
+		if err := signalTree(pid, syscall.SIGTERM); err != nil {
+			log.Printf("Error sending SIGTERM to pid %d: %v", pid, err)
+		}
+	}
+	if !waitForExit(pid, grace) {
+		result.Outcome = StopKilled
+		if err := signalTree(pid, syscall.SIGKILL); err != nil {
+			log.Printf("Error sending SIGKILL to pid %d: %v", pid, err)
+		}
+		if !waitForExit(pid, killTimeout) {
+			result.Outcome = StopFailed
+			result.Error = fmt.Sprintf("process still running %s after SIGKILL", killTimeout)
+		}
+	}
+	return result
+}
+
+// stopVMProcesses stops every tracked process of a VM and reports how each
+// one went down
+func (api *DrafterAPI) stopVMProcesses(rec *VMRecord, grace time.Duration) ([]StopResult, error) {
+	var results []StopResult
+	var failed []string
+	for _, component := range stopOrder {
+		result, ok := api.supervisor.Stop(rec.Name, component, grace)
+		if !ok {
+			pid, tracked := rec.PIDs[component]
+			if !tracked {
+				continue
+			}
+			result = stopPID(component, pid, grace)
+		}
+
+		log.Printf("Stopped %s of VM %s: %s", component, rec.Name, result.Outcome)
+		results = append(results, result)
+		if result.Outcome == StopFailed {
+			failed = append(failed, component)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to stop %s", strings.Join(failed, ", "))
+	}
+	return results, nil
+}
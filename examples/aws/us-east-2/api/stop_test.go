@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// denyKill makes the API unable to signal anything itself, as with the root
+// processes sudo starts, and records what is signalled through sudo kill
+func denyKill(t *testing.T, sudoErr error) *[][]int {
+	t.Helper()
+	var sudoKilled [][]int
+	kill, sudo := killProcess, sudoKill
+	killProcess = func(pid int, sig syscall.Signal) error { return syscall.EPERM }
+	sudoKill = func(sig syscall.Signal, pids []int) error {
+		sudoKilled = append(sudoKilled, pids)
+		if sudoErr != nil {
+			return sudoErr
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, sig)
+		}
+		return nil
+	}
+	t.Cleanup(func() { killProcess, sudoKill = kill, sudo })
+	return &sudoKilled
+}
+
+// startGroup starts a sleep in its own process group, like the supervisor
+// starts drafter commands
+func startGroup(t *testing.T) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+func TestSignalTreeThroughSudo(t *testing.T) {
+	sudoKilled := denyKill(t, nil)
+	cmd := startGroup(t)
+	pid := cmd.Process.Pid
+
+	if err := signalTree(pid, syscall.SIGTERM); err != nil {
+		t.Fatalf("signalTree() = %v", err)
+	}
+	if want := [][]int{{pid, -pid}}; !reflect.DeepEqual(*sudoKilled, want) {
+		t.Errorf("sudo kill signalled %v, want %v", *sudoKilled, want)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Error("the process exited cleanly, want it terminated by the signal")
+	}
+}
+
+func TestSignalTreeSudoFails(t *testing.T) {
+	denyKill(t, errors.New("sudo: a password is required"))
+	cmd := startGroup(t)
+
+	if err := signalTree(cmd.Process.Pid, syscall.SIGKILL); err == nil {
+		t.Error("signalTree() = nil although the process could not be signalled")
+	}
+
+	// A process that went away meanwhile needs no signal
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	if err := signalTree(cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		t.Errorf("signalTree() of an exited process = %v, want nil", err)
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	if !processAlive(pid) {
+		t.Error("processAlive() = false for a running process")
+	}
+
+	// An exited process that was not reaped yet is a zombie
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for processAlive(pid) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		t.Error("processAlive() = true for a zombie")
+	}
+	cmd.Wait()
+	if processAlive(pid) || processAlive(0) {
+		t.Error("processAlive() = true for a process that does not exist")
+	}
+}
+
+func TestSupervisorStopThroughSudo(t *testing.T) {
+	sudoKilled := denyKill(t, nil)
+	s := NewSupervisor()
+	if _, err := s.Start(ProcessSpec{VM: "vm", Component: "peer", Args: []string{"sleep", "60"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, ok := s.Stop("vm", "peer", 5*time.Second)
+	if !ok {
+		t.Fatal("Stop() did not find the process")
+	}
+	if result.Outcome != StopTerminated || result.Signal != syscall.SIGTERM.String() {
+		t.Errorf("Stop() = %+v, want the process terminated by SIGTERM", result)
+	}
+	if len(*sudoKilled) == 0 {
+		t.Error("the process was not signalled through sudo kill")
+	}
+}
+
+func TestSignalTreeDescendants(t *testing.T) {
+	// A shell that waits on two children stands in for sudo and drafter
+	cmd := exec.Command("sh", "-c", "sleep 60 & sleep 60 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	var children []int
+	deadline := time.Now().Add(5 * time.Second)
+	for len(children) < 2 && time.Now().Before(deadline) {
+		children = descendants(cmd.Process.Pid)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(children) != 2 {
+		t.Fatalf("descendants() = %v, want the two sleeps", children)
+	}
+
+	if err := signalTree(cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range children {
+		if !waitForExit(pid, 5*time.Second) {
+			t.Errorf("pid %d survived SIGKILL of its tree", pid)
+		}
+	}
+}
+
+func TestStopPID(t *testing.T) {
+	// A process left behind by an earlier run of the API, which ignores SIGTERM
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 60 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	go cmd.Wait()
+	// The trap is set once the shell has started its child
+	deadline := time.Now().Add(5 * time.Second)
+	for len(descendants(pid)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	result := stopPID("peer", pid, 200*time.Millisecond)
+	if result.Outcome != StopKilled || result.PID != pid || result.Duration == "" {
+		t.Errorf("stopPID() = %+v, want the process killed after the grace period", result)
+	}
+	if result := stopPID("peer", pid, time.Second); result.Outcome != StopNotRunning {
+		t.Errorf("stopPID() of a stopped process = %+v, want not-running", result)
+	}
+}
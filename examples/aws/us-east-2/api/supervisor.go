@@ -0,0 +1,455 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = "never"
+	RestartOnFailure RestartPolicy = "on-failure"
+	RestartAlways    RestartPolicy = "always"
+)
+
+const (
+	restartBackoffBase = time.Second
+	restartBackoffMax  = time.Minute
+	// A process that stayed up this long gets its backoff reset
+	restartBackoffReset = 5 * time.Minute
+	stderrTailSize      = 4096
+	// How often an adopted process is checked for having exited
+	adoptedPollInterval = time.Second
+)
+
+var (
+	ErrProcessRunning = errors.New("process already running")
+	// Adopted processes are not our children, so their exit status is lost
+	errAdoptedExit = errors.New("adopted process exited, exit status unknown")
+)
+
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	switch p := RestartPolicy(s); p {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown restart policy %q, must be one of never, on-failure, always", s)
+}
+
+// ProcessSpec describes a drafter child process owned by the supervisor.
+// VM is empty for host-wide processes such as drafter-nat.
+type ProcessSpec struct {
+	VM        string
+	Component string
+	Args      []string
+	LogPath   string
+	Restart   RestartPolicy
+}
+
+// ProcessStatus is a snapshot of a supervised process
+type ProcessStatus struct {
+	VM         string        `json:"vm,omitempty"`
+	Component  string        `json:"component"`
+	PID        int           `json:"pid"`
+	Running    bool          `json:"running"`
+	Restart    RestartPolicy `json:"restart_policy"`
+	Restarts   int           `json:"restarts"`
+	StartedAt  time.Time     `json:"started_at"`
+	ExitedAt   *time.Time    `json:"exited_at,omitempty"`
+	ExitCode   *int          `json:"exit_code,omitempty"`
+	Signal     string        `json:"signal,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	StderrTail string        `json:"stderr_tail,omitempty"`
+	Adopted    bool          `json:"adopted,omitempty"`
+}
+
+type process struct {
+	spec ProcessSpec
+	// cmd is nil for a process adopted from an earlier run of the API until
+	// it is restarted
+	cmd      *exec.Cmd
+	logFile  *os.File
+	stderr   *tailBuffer
+	status   ProcessStatus
+	stopping bool
+	// wake interrupts a restart backoff
+	wake chan struct{}
+	// done is closed once the process has exited for good
+	done chan struct{}
+}
+
+// Supervisor starts drafter processes, reaps them when they exit and
+// restarts them according to their restart policy
+type Supervisor struct {
+	mu    sync.Mutex
+	procs map[string]*process
+
+	// OnStart and OnExit are called without the lock held whenever a process
+	// is (re)started or exits
+	OnStart func(ProcessStatus)
+	OnExit  func(ProcessStatus)
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{procs: make(map[string]*process)}
+}
+
+func processKey(vm, component string) string {
+	return vm + "/" + component
+}
+
+// Start launches a process and begins supervising it
+func (s *Supervisor) Start(spec ProcessSpec) (ProcessStatus, error) {
+	if spec.Restart == "" {
+		spec.Restart = RestartNever
+	}
+	key := processKey(spec.VM, spec.Component)
+
+	s.mu.Lock()
+	if existing, ok := s.procs[key]; ok && !isDone(existing.done) {
+		s.mu.Unlock()
+		return ProcessStatus{}, fmt.Errorf("%w: %s (pid %d)", ErrProcessRunning, key, existing.status.PID)
+	}
+
+	p := &process{
+		spec:   spec,
+		stderr: newTailBuffer(stderrTailSize),
+		status: ProcessStatus{VM: spec.VM, Component: spec.Component, Restart: spec.Restart},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := s.launch(p); err != nil {
+		s.mu.Unlock()
+		return ProcessStatus{}, err
+	}
+	s.procs[key] = p
+	status := p.snapshot()
+	s.mu.Unlock()
+
+	s.notify(s.OnStart, status)
+	go s.supervise(p)
+	return status, nil
+}
+
+// Adopt takes over a process left running by an earlier run of the API. It
+// is watched until it exits and then restarted like any other process.
+func (s *Supervisor) Adopt(spec ProcessSpec, pid int, startedAt time.Time) (ProcessStatus, error) {
+	if spec.Restart == "" {
+		spec.Restart = RestartNever
+	}
+	key := processKey(spec.VM, spec.Component)
+
+	s.mu.Lock()
+	if existing, ok := s.procs[key]; ok && !isDone(existing.done) {
+		s.mu.Unlock()
+		return ProcessStatus{}, fmt.Errorf("%w: %s (pid %d)", ErrProcessRunning, key, existing.status.PID)
+	}
+
+	p := &process{
+		spec:   spec,
+		stderr: newTailBuffer(stderrTailSize),
+		status: ProcessStatus{
+			VM:        spec.VM,
+			Component: spec.Component,
+			PID:       pid,
+			Running:   true,
+			Restart:   spec.Restart,
+			StartedAt: startedAt.UTC(),
+			Adopted:   true,
+		},
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	s.procs[key] = p
+	status := p.snapshot()
+	s.mu.Unlock()
+
+	log.Printf("Supervisor adopted %s (pid %d)", key, pid)
+	s.notify(s.OnStart, status)
+	go s.supervise(p)
+	return status, nil
+}
+
+// launch starts the process; callers hold s.mu
+func (s *Supervisor) launch(p *process) error {
+	cmd := exec.Command(p.spec.Args[0], p.spec.Args[1:]...)
+
+	var logFile *os.File
+	if p.spec.LogPath != "" {
+		f, err := os.OpenFile(p.spec.LogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file for %s: %v", p.spec.Component, err)
+		}
+		logFile = f
+		// The process writes to the file itself rather than through a pipe
+		// to us, so it survives an API restart; the tail is read back from
+		// the file
+		cmd.Stdout = f
+		cmd.Stderr = f
+	} else {
+		cmd.Stdout = io.Discard
+		cmd.Stderr = p.stderr
+	}
+	// Grandchildren such as firecracker may hold the stderr pipe open after
+	// the process itself has exited
+	cmd.WaitDelay = 5 * time.Second
+	// Run in our own process group so stop can signal the whole tree
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	log.Printf("Supervisor starting %s: %s", processKey(p.spec.VM, p.spec.Component), strings.Join(p.spec.Args, " "))
+	if err := cmd.Start(); err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return fmt.Errorf("failed to start %s: %v", p.spec.Component, err)
+	}
+
+	p.cmd = cmd
+	p.logFile = logFile
+	p.status.PID = cmd.Process.Pid
+	p.status.Running = true
+	p.status.Adopted = false
+	p.status.StartedAt = time.Now().UTC()
+	p.status.ExitedAt = nil
+	p.status.ExitCode = nil
+	p.status.Signal = ""
+	p.status.Error = ""
+	return nil
+}
+
+func (s *Supervisor) supervise(p *process) {
+	backoff := restartBackoffBase
+	for {
+		var err error
+		if p.cmd == nil {
+			for processAlive(p.status.PID) {
+				time.Sleep(adoptedPollInterval)
+			}
+			err = errAdoptedExit
+		} else {
+			err = p.cmd.Wait()
+			if p.logFile != nil {
+				p.logFile.Close()
+			}
+		}
+
+		s.mu.Lock()
+		now := time.Now().UTC()
+		p.status.Running = false
+		p.status.ExitedAt = &now
+		failed := err != nil
+		if p.cmd != nil && p.cmd.ProcessState != nil {
+			state := p.cmd.ProcessState
+			code := state.ExitCode()
+			p.status.ExitCode = &code
+			if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				p.status.Signal = ws.Signal().String()
+			}
+		}
+		if err != nil {
+			p.status.Error = err.Error()
+		}
+		p.status.StderrTail = p.outputTail()
+		uptime := now.Sub(p.status.StartedAt)
+		restart := !p.stopping && (p.spec.Restart == RestartAlways || (p.spec.Restart == RestartOnFailure && failed))
+		status := p.snapshot()
+		s.mu.Unlock()
+
+		log.Printf("Supervisor: %s (pid %d) exited: %v", processKey(p.spec.VM, p.spec.Component), status.PID, err)
+		s.notify(s.OnExit, status)
+
+		if !restart {
+			close(p.done)
+			return
+		}
+
+		if uptime >= restartBackoffReset {
+			backoff = restartBackoffBase
+		}
+		log.Printf("Supervisor: restarting %s in %s", processKey(p.spec.VM, p.spec.Component), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-p.wake:
+		}
+		backoff *= 2
+		if backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+
+		s.mu.Lock()
+		if p.stopping {
+			s.mu.Unlock()
+			close(p.done)
+			return
+		}
+		err = s.launch(p)
+		if err != nil {
+			p.status.Error = err.Error()
+			s.mu.Unlock()
+			log.Printf("Supervisor: giving up on %s: %v", processKey(p.spec.VM, p.spec.Component), err)
+			close(p.done)
+			return
+		}
+		p.status.Restarts++
+		status = p.snapshot()
+		s.mu.Unlock()
+
+		s.notify(s.OnStart, status)
+	}
+}
+
+func (s *Supervisor) notify(fn func(ProcessStatus), status ProcessStatus) {
+	if fn != nil {
+		fn(status)
+	}
+}
+
+func (p *process) snapshot() ProcessStatus {
+	status := p.status
+	if status.Running {
+		status.StderrTail = p.outputTail()
+	}
+	return status
+}
+
+// outputTail returns the last output of the process
+func (p *process) outputTail() string {
+	if p.spec.LogPath == "" {
+		return p.stderr.String()
+	}
+	return readTail(p.spec.LogPath, stderrTailSize)
+}
+
+// readTail returns up to the last size bytes of a file
+func readTail(path string, size int64) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	offset := info.Size() - size
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, info.Size()-offset)
+	n, _ := f.ReadAt(buf, offset)
+	return string(buf[:n])
+}
+
+// Status returns the current state of a supervised process
+func (s *Supervisor) Status(vm, component string) (ProcessStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.procs[processKey(vm, component)]
+	if !ok {
+		return ProcessStatus{}, false
+	}
+	return p.snapshot(), true
+}
+
+// List returns every supervised process belonging to a VM
+func (s *Supervisor) List(vm string) []ProcessStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var statuses []ProcessStatus
+	for _, p := range s.procs {
+		if p.spec.VM == vm {
+			statuses = append(statuses, p.snapshot())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Component < statuses[j].Component })
+	return statuses
+}
+
+// Forget drops a finished process from the supervisor
+func (s *Supervisor) Forget(vm, component string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := processKey(vm, component)
+	if p, ok := s.procs[key]; ok && isDone(p.done) {
+		delete(s.procs, key)
+	}
+}
+
+func isDone(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// tailBuffer keeps the last size bytes written to it
+type tailBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// startProcess runs a drafter component under the supervisor, appending its
+// output to the component's log file
+func (api *DrafterAPI) startProcess(vm, component string, logManager *LogManager, args ...string) (ProcessStatus, error) {
+	return api.supervisor.Start(ProcessSpec{
+		VM:        vm,
+		Component: component,
+		Args:      args,
+		LogPath:   logManager.LogPath(component),
+		Restart:   api.config.restartPolicy(component),
+	})
+}
+
+// recordProcessStart keeps the registry's PIDs in sync across restarts
+func (api *DrafterAPI) recordProcessStart(status ProcessStatus) {
+	if status.VM == "" {
+		return
+	}
+	if _, err := api.registry.Update(status.VM, func(rec *VMRecord) error {
+		if rec.PIDs == nil {
+			rec.PIDs = make(map[string]int)
+		}
+		rec.PIDs[status.Component] = status.PID
+		return nil
+	}); err != nil && !errors.Is(err, ErrVMNotFound) {
+		log.Printf("Error recording PID of %s for VM %s: %v", status.Component, status.VM, err)
+	}
+}
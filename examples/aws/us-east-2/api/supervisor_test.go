@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitStatus polls a supervised process until done reports true for its status
+func waitStatus(t *testing.T, s *Supervisor, vm, component string, done func(ProcessStatus) bool) ProcessStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := s.Status(vm, component); ok && done(status) {
+			return status
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	status, _ := s.Status(vm, component)
+	t.Fatalf("%s did not get there, last status %+v", processKey(vm, component), status)
+	return status
+}
+
+func exited(status ProcessStatus) bool {
+	return !status.Running && status.ExitedAt != nil
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, policy := range []RestartPolicy{RestartNever, RestartOnFailure, RestartAlways} {
+		if got, err := ParseRestartPolicy(string(policy)); err != nil || got != policy {
+			t.Errorf("ParseRestartPolicy(%q) = %q, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseRestartPolicy("sometimes"); err == nil {
+		t.Error("ParseRestartPolicy() accepted an unknown policy")
+	}
+}
+
+func TestSupervisorRestartOnFailure(t *testing.T) {
+	var mu sync.Mutex
+	var exits []ProcessStatus
+	s := NewSupervisor()
+	s.OnExit = func(status ProcessStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		exits = append(exits, status)
+	}
+
+	// Fails the first time and succeeds once restarted
+	marker := filepath.Join(t.TempDir(), "ran")
+	if _, err := s.Start(ProcessSpec{
+		VM:        "vm",
+		Component: "forwarder",
+		Args:      []string{"sh", "-c", "test -f " + marker + " || { touch " + marker + "; exit 3; }"},
+		Restart:   RestartOnFailure,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitStatus(t, s, "vm", "forwarder", func(status ProcessStatus) bool {
+		return exited(status) && status.Restarts == 1
+	})
+	if status.ExitCode == nil || *status.ExitCode != 0 {
+		t.Errorf("restarted process exited with %v, want 0", status.ExitCode)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exits) != 2 || exits[0].ExitCode == nil || *exits[0].ExitCode != 3 {
+		t.Errorf("OnExit saw %+v, want exit code 3 and then 0", exits)
+	}
+}
+
+func TestSupervisorOutput(t *testing.T) {
+	s := NewSupervisor()
+	logPath := filepath.Join(t.TempDir(), "peer.log")
+	for component, logFile := range map[string]string{"snapshotter": "", "peer": logPath} {
+		if _, err := s.Start(ProcessSpec{
+			VM:        "vm",
+			Component: component,
+			Args:      []string{"sh", "-c", "echo resume failed >&2; exit 1"},
+			LogPath:   logFile,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		status := waitStatus(t, s, "vm", component, exited)
+		if status.ExitCode == nil || *status.ExitCode != 1 || status.Restarts != 0 {
+			t.Errorf("%s exited with %v after %d restarts, want 1 and none", component, status.ExitCode, status.Restarts)
+		}
+		if !strings.Contains(status.StderrTail, "resume failed") {
+			t.Errorf("%s output tail = %q, want the error it printed", component, status.StderrTail)
+		}
+	}
+	if data, err := os.ReadFile(logPath); err != nil || !strings.Contains(string(data), "resume failed") {
+		t.Errorf("log file holds %q, %v, want the output", data, err)
+	}
+	if got := len(s.List("vm")); got != 2 {
+		t.Errorf("List(vm) has %d processes, want 2", got)
+	}
+}
+
+func TestSupervisorStartRunning(t *testing.T) {
+	s := NewSupervisor()
+	spec := ProcessSpec{VM: "vm", Component: "peer", Args: []string{"sleep", "60"}}
+	status, err := s.Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start(spec); !errors.Is(err, ErrProcessRunning) {
+		t.Errorf("second Start() = %v, want ErrProcessRunning", err)
+	}
+
+	if err := syscall.Kill(status.PID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	status = waitStatus(t, s, "vm", "peer", exited)
+	if status.Signal != syscall.SIGKILL.String() {
+		t.Errorf("killed process reports signal %q, want %q", status.Signal, syscall.SIGKILL)
+	}
+	// Once it has exited for good it can be forgotten
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.Forget("vm", "peer")
+		if _, ok := s.Status("vm", "peer"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the exited process could not be forgotten")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buf := newTailBuffer(8)
+	buf.Write([]byte("drafter "))
+	buf.Write([]byte("peer exited"))
+	if got := buf.String(); got != "r exited" {
+		t.Errorf("tail = %q, want the last 8 bytes", got)
+	}
+}
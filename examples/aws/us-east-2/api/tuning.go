@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultTuningProfile = "default"
+
+// tuningProfiles are the presets a tuning spec can start from
+var tuningProfiles = map[string]DeviceTuning{
+	defaultTuningProfile: defaultDeviceTuning,
+	// Keep copying until few blocks are dirty, so the VM is paused only
+	// briefly for the last pass, at the cost of more traffic
+	"low-downtime": {
+		BlockSize:      16 << 10,
+		Expiry:         time.Second,
+		MaxDirtyBlocks: 50,
+		MinCycles:      10,
+		MaxCycles:      50,
+		CycleThrottle:  100 * time.Millisecond,
+	},
+	// Copy few passes spaced far apart and accept a longer pause at the end
+	"low-bandwidth": {
+		BlockSize:      256 << 10,
+		Expiry:         5 * time.Second,
+		MaxDirtyBlocks: 1000,
+		MinCycles:      1,
+		MaxCycles:      5,
+		CycleThrottle:  2 * time.Second,
+	},
+}
+
+// TuningSpec picks a profile and overrides some of its values. Durations are
+// strings such as "500ms".
+type TuningSpec struct {
+	Profile        string  `json:"profile,omitempty"`
+	BlockSize      *uint32 `json:"block_size,omitempty"`
+	Expiry         string  `json:"expiry,omitempty"`
+	MaxDirtyBlocks *int    `json:"max_dirty_blocks,omitempty"`
+	MinCycles      *int    `json:"min_cycles,omitempty"`
+	MaxCycles      *int    `json:"max_cycles,omitempty"`
+	CycleThrottle  string  `json:"cycle_throttle,omitempty"`
+}
+
+// MigrationTuning is the tuning of a VM's devices: a spec for the whole VM
+// and optional specs for single devices. A device's profile replaces the
+// VM's profile, and its overrides are applied after the VM's.
+type MigrationTuning struct {
+	TuningSpec
+	Devices map[string]TuningSpec `json:"devices,omitempty"`
+}
+
+func profileNames() string {
+	names := make([]string, 0, len(tuningProfiles))
+	for name := range tuningProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// apply overrides the values the spec sets
+func (s TuningSpec) apply(t *DeviceTuning) error {
+	if s.BlockSize != nil {
+		t.BlockSize = *s.BlockSize
+	}
+	if s.Expiry != "" {
+		d, err := time.ParseDuration(s.Expiry)
+		if err != nil {
+			return fmt.Errorf("invalid expiry %q", s.Expiry)
+		}
+		t.Expiry = d
+	}
+	if s.MaxDirtyBlocks != nil {
+		t.MaxDirtyBlocks = *s.MaxDirtyBlocks
+	}
+	if s.MinCycles != nil {
+		t.MinCycles = *s.MinCycles
+	}
+	if s.MaxCycles != nil {
+		t.MaxCycles = *s.MaxCycles
+	}
+	if s.CycleThrottle != "" {
+		d, err := time.ParseDuration(s.CycleThrottle)
+		if err != nil {
+			return fmt.Errorf("invalid cycle_throttle %q", s.CycleThrottle)
+		}
+		t.CycleThrottle = d
+	}
+	return nil
+}
+
+// Device returns the tuning of one device. A nil tuning is the default
+// profile.
+func (m *MigrationTuning) Device(device string) (DeviceTuning, error) {
+	if m == nil {
+		return defaultDeviceTuning, nil
+	}
+
+	deviceSpec := m.Devices[device]
+	profile := m.Profile
+	if deviceSpec.Profile != "" {
+		profile = deviceSpec.Profile
+	}
+	if profile == "" {
+		profile = defaultTuningProfile
+	}
+	tuning, ok := tuningProfiles[profile]
+	if !ok {
+		return DeviceTuning{}, fmt.Errorf("unknown tuning profile %q, must be one of %s", profile, profileNames())
+	}
+
+	if err := m.TuningSpec.apply(&tuning); err != nil {
+		return DeviceTuning{}, err
+	}
+	if err := deviceSpec.apply(&tuning); err != nil {
+		return DeviceTuning{}, fmt.Errorf("device %s: %v", device, err)
+	}
+	return tuning, nil
+}
+
+// Resolve returns the tuning of every device, checking that the spec only
+// names known devices and gives each one values drafter-peer accepts
+func (m *MigrationTuning) Resolve() (map[string]DeviceTuning, error) {
+	if m != nil {
+		for device := range m.Devices {
+			if !knownDevice(device) {
+				return nil, fmt.Errorf("unknown device %q in tuning", device)
+			}
+		}
+	}
+
+	resolved := make(map[string]DeviceTuning, len(packageFiles))
+	for _, f := range packageFiles {
+		tuning, err := m.Device(f.Device)
+		if err != nil {
+			return nil, err
+		}
+		if err := tuning.validate(); err != nil {
+			return nil, fmt.Errorf("tuning of device %s: %v", f.Device, err)
+		}
+		resolved[f.Device] = tuning
+	}
+	return resolved, nil
+}
+
+func knownDevice(name string) bool {
+	for _, f := range packageFiles {
+		if f.Device == name {
+			return true
+		}
+	}
+	return false
+}
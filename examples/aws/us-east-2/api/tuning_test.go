@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrationTuningResolve(t *testing.T) {
+	lowDowntime := tuningProfiles["low-downtime"]
+	lowBandwidth := tuningProfiles["low-bandwidth"]
+	withCycles := func(tuning DeviceTuning, min, max int) DeviceTuning {
+		tuning.MinCycles, tuning.MaxCycles = min, max
+		return tuning
+	}
+
+	tests := []struct {
+		name   string
+		tuning string
+		// want is the tuning of the memory device and of the other devices
+		wantMemory, wantOthers DeviceTuning
+	}{
+		{"none", ``, defaultDeviceTuning, defaultDeviceTuning},
+		{"profile", `{"profile": "low-downtime"}`, lowDowntime, lowDowntime},
+		{
+			"device profile replaces the VM's",
+			`{"profile": "low-downtime", "devices": {"memory": {"profile": "low-bandwidth"}}}`,
+			lowBandwidth, lowDowntime,
+		},
+		{
+			"device overrides apply after the VM's",
+			`{"min_cycles": 2, "max_cycles": 20, "devices": {"memory": {"max_cycles": 40}}}`,
+			withCycles(defaultDeviceTuning, 2, 40), withCycles(defaultDeviceTuning, 2, 20),
+		},
+		{
+			"VM overrides apply to a device's profile",
+			`{"profile": "low-downtime", "min_cycles": 2, "devices": {"memory": {"profile": "low-bandwidth"}}}`,
+			withCycles(lowBandwidth, 2, lowBandwidth.MaxCycles), withCycles(lowDowntime, 2, lowDowntime.MaxCycles),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tuning *MigrationTuning
+			if tt.tuning != "" {
+				tuning = &MigrationTuning{}
+				if err := json.Unmarshal([]byte(tt.tuning), tuning); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resolved, err := tuning.Resolve()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resolved) != len(packageFiles) {
+				t.Fatalf("resolved %d devices, want %d", len(resolved), len(packageFiles))
+			}
+			for device, got := range resolved {
+				want := tt.wantOthers
+				if device == "memory" {
+					want = tt.wantMemory
+				}
+				if got != want {
+					t.Errorf("device %s = %+v, want %+v", device, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrationTuningOverrides(t *testing.T) {
+	blockSize := uint32(64 << 10)
+	dirty := 7
+	tuning := &MigrationTuning{TuningSpec: TuningSpec{
+		BlockSize:      &blockSize,
+		Expiry:         "250ms",
+		MaxDirtyBlocks: &dirty,
+		CycleThrottle:  "0s",
+	}}
+	got, err := tuning.Device("disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultDeviceTuning
+	want.BlockSize, want.Expiry, want.MaxDirtyBlocks, want.CycleThrottle = blockSize, 250*time.Millisecond, dirty, 0
+	if got != want {
+		t.Errorf("Device() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMigrationTuningInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		tuning  string
+		wantErr string
+	}{
+		{"unknown profile", `{"profile": "fast"}`, `unknown tuning profile "fast"`},
+		{"unknown device profile", `{"devices": {"disk": {"profile": "fast"}}}`, `unknown tuning profile "fast"`},
+		{"unknown device", `{"devices": {"swap": {}}}`, `unknown device "swap"`},
+		{"invalid expiry", `{"expiry": "soon"}`, `invalid expiry "soon"`},
+		{"invalid device throttle", `{"devices": {"disk": {"cycle_throttle": "1"}}}`, `device disk: invalid cycle_throttle "1"`},
+		{"block size not a power of two", `{"block_size": 3000}`, "blockSize must be a power of two"},
+		{"no dirty blocks", `{"max_dirty_blocks": 0}`, "maxDirtyBlocks must be at least 1"},
+		{"fewer max than min cycles", `{"devices": {"memory": {"min_cycles": 5, "max_cycles": 2}}}`, "tuning of device memory: maxCycles must be at least minCycles"},
+		{"negative expiry", `{"expiry": "-1s"}`, "expiry must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tuning := &MigrationTuning{}
+			if err := json.Unmarshal([]byte(tt.tuning), tuning); err != nil {
+				t.Fatal(err)
+			}
+			_, err := tuning.Resolve()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Resolve() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Workload is the OCI package a VM runs and the port it serves inside the VM
+type Workload struct {
+	Name string `json:"name"`
+	// Package is an http(s) URL or an absolute path to an OCI package
+	Package string `json:"package"`
+	Port    int    `json:"port"`
+}
+
+// defaultWorkloadPort is the port Valkey serves on
+const defaultWorkloadPort = 6379
+
+// defaultWorkload is what VMs run unless asked otherwise, the Valkey package
+// of the release
+func (s ArtifactSource) defaultWorkload() Workload {
+	return Workload{
+		Name:    artifactValkey,
+		Package: s.location(artifactValkey),
+		Port:    defaultWorkloadPort,
+	}
+}
+
+// isURL reports whether a package is downloaded rather than read from disk
+func (w Workload) isURL() bool {
+	return strings.HasPrefix(w.Package, "http://") || strings.HasPrefix(w.Package, "https://")
+}
+
+// fileName is the name of the package file without its directory
+func (w Workload) fileName() string {
+	if w.isURL() {
+		if u, err := url.Parse(w.Package); err == nil {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(w.Package)
+}
+
+// portString is the workload's port as drafter-forwarder wants it
+func (w Workload) portString() string {
+	return strconv.Itoa(w.Port)
+}
+
+// workloadName guesses a name from a package file such as
+// oci-valkey-x86_64.tar.zst
+func workloadName(file string) string {
+	name := file
+	if i := strings.Index(name, ".tar"); i > 0 {
+		name = name[:i]
+	}
+	name = strings.TrimPrefix(name, "oci-")
+	for _, arch := range []string{"-x86_64", "-amd64", "-aarch64", "-arm64"} {
+		name = strings.TrimSuffix(name, arch)
+	}
+	return name
+}
+
+// resolveWorkload fills in a workload's defaults from defaultWorkload and
+// checks it. image_path is a shorthand for the package of the workload.
+func (s PackageSpec) resolveWorkload(defaultWorkload Workload) (Workload, error) {
+	if s.Workload == nil && s.ImagePath == "" {
+		return defaultWorkload, nil
+	}
+
+	var w Workload
+	if s.Workload != nil {
+		w = *s.Workload
+	}
+	switch {
+	case w.Package == "":
+		w.Package = s.ImagePath
+	case s.ImagePath != "" && s.ImagePath != w.Package:
+		return w, fmt.Errorf("image_path %q and workload.package %q disagree, set only one", s.ImagePath, w.Package)
+	}
+
+	if w.Package == "" {
+		if w.Name != "" && w.Name != defaultWorkload.Name {
+			return w, fmt.Errorf("workload %q needs a package", w.Name)
+		}
+		w.Package = defaultWorkload.Package
+		if w.Name == "" {
+			w.Name = defaultWorkload.Name
+		}
+	}
+	if w.isURL() {
+		u, err := url.Parse(w.Package)
+		if err != nil || u.Host == "" || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+			return w, fmt.Errorf("workload.package %q is not a valid package URL", w.Package)
+		}
+	} else if err := checkLocalPackage(w.Package); err != nil {
+		return w, fmt.Errorf("workload.package: %v", err)
+	}
+
+	if w.Name == "" {
+		w.Name = workloadName(w.fileName())
+	}
+	if err := validateName("workload", w.Name); err != nil {
+		return w, err
+	}
+
+	if w.Port == 0 {
+		w.Port = defaultWorkload.Port
+	}
+	if w.Port < 1 || w.Port > 65535 {
+		return w, fmt.Errorf("workload.port must be between 1 and 65535, got %d", w.Port)
+	}
+	return w, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkloadName(t *testing.T) {
+	tests := map[string]string{
+		"oci-valkey-x86_64.tar.zst": "valkey",
+		"oci-redis-amd64.tar":       "redis",
+		"postgres-arm64.tar.gz":     "postgres",
+		"nginx":                     "nginx",
+	}
+	for file, want := range tests {
+		if got := workloadName(file); got != want {
+			t.Errorf("workloadName(%q) = %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestResolveWorkload(t *testing.T) {
+	valkey := Workload{Name: "valkey", Package: "https://example.com/oci-valkey-x86_64.tar.zst", Port: defaultWorkloadPort}
+	local := filepath.Join(t.TempDir(), "oci-redis-x86_64.tar.zst")
+	if err := os.WriteFile(local, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		spec PackageSpec
+		want Workload
+	}{
+		{"default", PackageSpec{}, valkey},
+		{"image path", PackageSpec{ImagePath: local}, Workload{Name: "redis", Package: local, Port: defaultWorkloadPort}},
+		{
+			"named local package",
+			PackageSpec{Workload: &Workload{Name: "cache", Package: local, Port: 6380}},
+			Workload{Name: "cache", Package: local, Port: 6380},
+		},
+		{
+			"image path and the same package",
+			PackageSpec{ImagePath: local, Workload: &Workload{Package: local}},
+			Workload{Name: "redis", Package: local, Port: defaultWorkloadPort},
+		},
+		{
+			"URL",
+			PackageSpec{Workload: &Workload{Package: "https://example.com/oci-nginx-amd64.tar.zst", Port: 80}},
+			Workload{Name: "nginx", Package: "https://example.com/oci-nginx-amd64.tar.zst", Port: 80},
+		},
+		{"default with another port", PackageSpec{Workload: &Workload{Port: 7000}}, Workload{Name: "valkey", Package: valkey.Package, Port: 7000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.resolveWorkload(valkey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveWorkload() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveWorkloadInvalid(t *testing.T) {
+	valkey := Workload{Name: "valkey", Package: "https://example.com/oci-valkey-x86_64.tar.zst", Port: defaultWorkloadPort}
+	dir := t.TempDir()
+	local := filepath.Join(dir, "oci-redis-x86_64.tar.zst")
+	if err := os.WriteFile(local, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		spec    PackageSpec
+		wantErr string
+	}{
+		{"disagreeing packages", PackageSpec{ImagePath: local, Workload: &Workload{Package: "/srv/other.tar"}}, "disagree"},
+		{"name without a package", PackageSpec{Workload: &Workload{Name: "redis"}}, `workload "redis" needs a package`},
+		{"relative package", PackageSpec{ImagePath: "oci.tar"}, "is not absolute"},
+		{"missing package", PackageSpec{ImagePath: filepath.Join(dir, "missing.tar")}, "no such file"},
+		{"directory", PackageSpec{ImagePath: dir}, "is not a file"},
+		{"URL without a file", PackageSpec{ImagePath: "https://example.com/"}, "is not a valid package URL"},
+		{"invalid name", PackageSpec{Workload: &Workload{Name: "Redis Cache", Package: local}}, "workload"},
+		{"port out of range", PackageSpec{Workload: &Workload{Package: local, Port: 70000}}, "workload.port must be between 1 and 65535"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.spec.resolveWorkload(valkey)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("resolveWorkload() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}